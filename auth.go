@@ -0,0 +1,113 @@
+package gorpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// Principal is the identity of the client authenticated on a connection
+type Principal struct {
+	Name    string
+	Expires time.Time // the calls are rejected after it, zero means never
+}
+
+// a nil principal is not authenticated
+func (p *Principal) valid(now time.Time) bool {
+	return p != nil && (p.Expires.IsZero() || now.Before(p.Expires))
+}
+
+// Authenticator validates the token sent by the client in the handshake of a new
+// connection. the connection is rejected with ErrUnauthenticated if err is not nil.
+// the token is sent in plaintext, use it over tls
+type Authenticator interface {
+	Authenticate(token string, remoteAddr net.Addr) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator
+type AuthenticatorFunc func(token string, remoteAddr net.Addr) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(token string, remoteAddr net.Addr) (*Principal, error) {
+	return f(token, remoteAddr)
+}
+
+type tokenAuthenticator map[string]string
+
+// authenticate the static tokens, tokens maps the token to the principal name
+func NewTokenAuthenticator(tokens map[string]string) Authenticator {
+	ta := make(tokenAuthenticator, len(tokens))
+	for token, name := range tokens {
+		ta[token] = name
+	}
+	return ta
+}
+
+func (ta tokenAuthenticator) Authenticate(token string, remoteAddr net.Addr) (*Principal, error) {
+	// compare all the tokens in constant time
+	var principal *Principal
+	for t, name := range ta {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			principal = &Principal{Name: name}
+		}
+	}
+	if principal == nil {
+		return nil, errInvalidToken
+	}
+	return principal, nil
+}
+
+type hmacAuthenticator []byte
+
+// authenticate the tokens issued by NewHMACToken with the same key,
+// the principal expires with the token
+func NewHMACAuthenticator(key []byte) Authenticator {
+	return hmacAuthenticator(key)
+}
+
+// issue the token of name expiring at expires: name.expires.signature,
+// expires is in unix seconds and signature is the base64 of hmac-sha256
+func NewHMACToken(key []byte, name string, expires time.Time) string {
+	payload := name + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + hmacSign(key, payload)
+}
+
+func hmacSign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (key hmacAuthenticator) Authenticate(token string, remoteAddr net.Addr) (*Principal, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, errInvalidToken
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(hmacSign(key, payload))) {
+		return nil, errInvalidToken
+	}
+	i = strings.LastIndex(payload, ".")
+	if i < 0 {
+		return nil, errInvalidToken
+	}
+	expires, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	principal := &Principal{Name: payload[:i], Expires: time.Unix(expires, 0)}
+	if !principal.valid(time.Now()) {
+		return nil, errTokenExpired
+	}
+	return principal, nil
+}
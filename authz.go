@@ -0,0 +1,144 @@
+package gorpc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// AccessRequest is checked by the Authorizer before the argument is decoded
+type AccessRequest struct {
+	RemoteAddr net.Addr
+	Principal  *Principal // authenticated client, nil without Authenticator
+	Caller     string     // identity claimed by the client in the request header, not verified
+	Service    string
+	Method     string
+}
+
+// the identity of the client, the principal if authenticated or else the caller
+func (req *AccessRequest) Identity() string {
+	if req.Principal != nil {
+		return req.Principal.Name
+	}
+	return req.Caller
+}
+
+// Authorizer decides whether the call is allowed, the call is rejected with
+// ErrForbidden if err is not nil
+type Authorizer interface {
+	Authorize(req *AccessRequest) error
+}
+
+// AccessRule allows the callers from the networks, an empty field allows any
+type AccessRule struct {
+	Identities []string // checked against AccessRequest.Identity
+	Networks   []string // CIDRs or IPs of the remote address
+}
+
+type accessRule struct {
+	identities map[string]bool
+	networks   []*net.IPNet
+}
+
+var (
+	errAccessDenied     = errors.New("access denied")
+	errIdentityDenied   = errors.New("identity not allowed")
+	errRemoteAddrDenied = errors.New("remote address not allowed")
+)
+
+// AccessPolicy is an Authorizer keyed by service and method. the rule of the
+// method takes precedence over the rule of its service, the calls without any
+// rule are allowed if defaultAllow
+type AccessPolicy struct {
+	sync.RWMutex
+	rules        map[string]*accessRule
+	defaultAllow bool
+}
+
+func NewAccessPolicy(defaultAllow bool) *AccessPolicy {
+	return &AccessPolicy{rules: make(map[string]*accessRule), defaultAllow: defaultAllow}
+}
+
+// set the rule of the service, or the method of the service if method is not empty.
+// return error if a network can not be parsed
+func (p *AccessPolicy) SetRule(service, method string, rule AccessRule) error {
+	r := &accessRule{}
+	if len(rule.Identities) > 0 {
+		r.identities = make(map[string]bool, len(rule.Identities))
+		for _, identity := range rule.Identities {
+			r.identities[identity] = true
+		}
+	}
+	for _, network := range rule.Networks {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return err
+		}
+		r.networks = append(r.networks, ipNet)
+	}
+	p.Lock()
+	p.rules[accessKey(service, method)] = r
+	p.Unlock()
+	return nil
+}
+
+func accessKey(service, method string) string {
+	if method == "" {
+		return service
+	}
+	return service + "." + method
+}
+
+func (p *AccessPolicy) Authorize(req *AccessRequest) error {
+	p.RLock()
+	rule, ok := p.rules[accessKey(req.Service, req.Method)]
+	if !ok {
+		rule, ok = p.rules[req.Service]
+	}
+	p.RUnlock()
+	if !ok {
+		if p.defaultAllow {
+			return nil
+		}
+		return errAccessDenied
+	}
+	if rule.identities != nil && !rule.identities[req.Identity()] {
+		return errIdentityDenied
+	}
+	if len(rule.networks) > 0 && !rule.allowAddr(req.RemoteAddr) {
+		return errRemoteAddrDenied
+	}
+	return nil
+}
+
+// the address without ip, such as a unix socket, is not allowed
+func (rule *accessRule) allowAddr(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				ip = net.ParseIP(host)
+			}
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range rule.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package gorpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/johntech-o/timewheel"
+)
+
+// BatchCall is a call sent by Client.Batch, set Reply to nil to send only
+type BatchCall struct {
+	Service string
+	Method  string
+	Args    interface{}
+	Reply   interface{}
+}
+
+// Batch calls the methods of the server, see BatchContext
+func (this *Client) Batch(serverAddress string, calls []*BatchCall) []*Error {
+	return this.BatchContext(context.Background(), serverAddress, calls)
+}
+
+// BatchContext pipelines the calls on one connection to the server, written to the
+// network with one flush, and waits for all of them. the errors are returned in the
+// order of calls, nil for the calls succeeded. the batch waits for the longest timeout
+// of the methods and the calls are not retried. every call goes through the interceptors
+// of the client, the calls reaching the innermost invoker are sent together to the
+// address of the call, which the interceptors may rewrite
+func (this *Client) BatchContext(ctx context.Context, serverAddress string, calls []*BatchCall) []*Error {
+	errs := make([]*Error, len(calls))
+	if len(calls) == 0 {
+		return errs
+	}
+	if serverAddress == "" {
+		return fillErrors(errs, 0, ErrInvalidAddress.SetReason("client remote address is empty"))
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fillErrors(errs, 0, ErrRequestCanceled.SetError(ctxErr))
+	}
+	clientCalls := make([]*ClientCall, len(calls))
+	this.RLock()
+	for i, call := range calls {
+		clientCalls[i] = &ClientCall{
+			Context: ctx,
+			Address: serverAddress,
+			Service: call.Service,
+			Method:  call.Method,
+			Args:    call.Args,
+			Reply:   call.Reply,
+			Caller:  this.caller,
+		}
+	}
+	interceptors := this.interceptors
+	this.RUnlock()
+	if len(interceptors) > 0 {
+		return this.interceptBatch(ctx, clientCalls, interceptors)
+	}
+	return this.sendBatch(ctx, serverAddress, clientCalls)
+}
+
+func fillErrors(errs []*Error, from int, err *Error) []*Error {
+	for i := from; i < len(errs); i++ {
+		errs[i] = err
+	}
+	return errs
+}
+
+// run every call through the interceptors on its own goroutine. the innermost invoker
+// holds the call until all the calls arrive or are short-circuited, then the calls held
+// are sent by one batch per server address, which an interceptor may rewrite.
+// a call invoked again, such as retried by an interceptor, is sent alone
+func (this *Client) interceptBatch(ctx context.Context, calls []*ClientCall, interceptors []ClientInterceptor) []*Error {
+	errs := make([]*Error, len(calls))
+	held := make([]*ClientCall, len(calls))
+	results := make([]chan *Error, len(calls))
+	arrived := make(chan struct{}, len(calls))
+	var wg sync.WaitGroup
+	for i := range calls {
+		i := i
+		results[i] = make(chan *Error, 1)
+		var once sync.Once
+		var invoker ClientInvoker = func(call *ClientCall) *Error {
+			first := false
+			once.Do(func() {
+				first = true
+				held[i] = call
+				arrived <- struct{}{}
+			})
+			if !first {
+				return this.invoke(call)
+			}
+			return <-results[i]
+		}
+		for j := len(interceptors) - 1; j >= 0; j-- {
+			invoker = chainClientInterceptor(interceptors[j], invoker)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = invoker(calls[i])
+			// short-circuited without reaching the innermost invoker
+			once.Do(func() { arrived <- struct{}{} })
+		}()
+	}
+	for range calls {
+		<-arrived
+	}
+	var addresses []string
+	indexes := make(map[string][]int)
+	for i, call := range held {
+		if call == nil {
+			continue
+		}
+		if _, ok := indexes[call.Address]; !ok {
+			addresses = append(addresses, call.Address)
+		}
+		indexes[call.Address] = append(indexes[call.Address], i)
+	}
+	for _, address := range addresses {
+		go func(address string, index []int) {
+			batch := make([]*ClientCall, len(index))
+			for j, i := range index {
+				batch[j] = held[i]
+			}
+			for j, err := range this.sendBatch(ctx, address, batch) {
+				results[index[j]] <- err
+			}
+		}(address, indexes[address])
+	}
+	wg.Wait()
+	return errs
+}
+
+// send the calls by one batch and wait for the responses
+func (this *Client) sendBatch(ctx context.Context, serverAddress string, calls []*ClientCall) []*Error {
+	errs := make([]*Error, len(calls))
+	if serverAddress == "" {
+		return fillErrors(errs, 0, ErrInvalidAddress.SetReason("client remote address is empty"))
+	}
+	requests := make([]*Request, len(calls))
+	presps := make([]*PendingResponse, len(calls))
+	var connectTimeout, timeout time.Duration
+	for i, call := range calls {
+		netOptions := this.getNetOptions(call.Service, call.Method)
+		requests[i] = newCallRequest(call, netOptions)
+		presps[i] = NewPendingResponse()
+		presps[i].reply = call.Reply
+		if netOptions.connectTimeout > connectTimeout {
+			connectTimeout = netOptions.connectTimeout
+		}
+		if d := netOptions.readTimeout + netOptions.writeTimeout; d > timeout {
+			timeout = d
+		}
+	}
+	rpcConn, err := this.getConnPool(serverAddress).Conn(connectTimeout, false)
+	if err != nil {
+		return fillErrors(errs, 0, err)
+	}
+	timer := timewheel.NewTimer(timeout)
+	// the calls stop waiting with it once the batch times out or is canceled
+	var stop *Error
+	sent := 0
+	for sent < len(calls) && stop == nil {
+		n, err := this.transferBatch(rpcConn, requests[sent:], presps[sent:])
+		if err != nil {
+			fillErrors(errs, sent, err)
+			break
+		}
+		sent += n
+		if sent == len(calls) {
+			break
+		}
+		// the pending queue of the connection is full, wait for the write goroutine
+		select {
+		case <-timer.C:
+			stop = ErrRequestTimeout
+		case <-ctx.Done():
+			stop = ErrRequestCanceled.SetError(ctx.Err())
+		case <-rpcConn.writable:
+		case <-rpcConn.done:
+			stop = ErrPendingWireBroken
+		}
+	}
+	if stop != nil {
+		fillErrors(errs, sent, stop)
+	}
+	for i, presp := range presps[:sent] {
+		if stop == nil {
+			select {
+			case <-presp.done:
+				errs[i] = presp.err
+				continue
+			case <-timer.C:
+				stop = ErrRequestTimeout
+			case <-ctx.Done():
+				stop = ErrRequestCanceled.SetError(ctx.Err())
+			}
+		}
+		select {
+		case <-presp.done:
+			errs[i] = presp.err
+		default:
+			if this.abandon(rpcConn, requests[i], presp) {
+				errs[i] = stop
+			} else {
+				errs[i] = presp.err
+			}
+		}
+	}
+	return errs
+}
+
+// queue the requests as many as the pending queue of the connection takes,
+// the last one queued flushes the others. return the number queued
+func (this *Client) transferBatch(rpcConn *ConnDriver, requests []*Request, presps []*PendingResponse) (int, *Error) {
+	rpcConn.Lock()
+	defer rpcConn.Unlock()
+	if rpcConn.netError != nil {
+		if e, ok := rpcConn.netError.(*Error); ok {
+			return 0, e
+		}
+		return 0, ErrUnknow.SetError(rpcConn.netError)
+	}
+	// the queue only shrinks while the connection is locked
+	n := cap(rpcConn.pendingRequests) - len(rpcConn.pendingRequests)
+	if n > len(requests) {
+		n = len(requests)
+	}
+	for i := 0; i < n; i++ {
+		sequence := rpcConn.Sequence()
+		requests[i].header.Seq = sequence
+		requests[i].batched = i < n-1
+		rpcConn.AddPendingRequest(requests[i])
+		presps[i].seq = sequence
+		presps[i].connId = rpcConn.connId
+		rpcConn.AddPendingResponse(presps[i])
+	}
+	return n, nil
+}
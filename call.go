@@ -0,0 +1,180 @@
+package gorpc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Call is an asynchronous call started by Client.Go
+type Call struct {
+	Service string
+	Method  string
+	Args    interface{}
+	Reply   interface{}
+	Error   *Error     // set when the call is complete
+	Done    chan *Call // receives the call itself when it is complete
+
+	client     *Client
+	cp         *ConnPool
+	netOptions *NetOptions
+	request    *Request
+	presp      *PendingResponse
+	timerLock  sync.Mutex // protects timer, conn and timedOut
+	timer      *time.Timer
+	conn       *ConnDriver // the connection the request is sent on
+	timedOut   bool
+	retries    int
+	state      int32 // 1 once complete
+}
+
+// Go calls the method of a server asynchronously, see GoWithAddress
+func (this *Client) Go(service, method string, args interface{}, reply interface{}, done chan *Call) *Call {
+	serverAddress, err := this.getAddress()
+	if err != nil {
+		call := newCall(service, method, args, reply, done)
+		call.finish(err)
+		return call
+	}
+	return this.GoWithAddress(serverAddress, service, method, args, reply, done)
+}
+
+// GoWithAddress sends the call and returns at once, the call is sent to done when it
+// is complete. done must be buffered, a new one is allocated if it is nil.
+// the call times out and retries as CallWithAddress without any goroutine waiting for it.
+// the interceptors wrap the synchronous invocation, so once the client has interceptors
+// every call holds a goroutine until it is complete
+func (this *Client) GoWithAddress(serverAddress, service, method string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(service, method, args, reply, done)
+	if serverAddress == "" {
+		call.finish(ErrInvalidAddress.SetReason("client remote address is empty"))
+		return call
+	}
+	clientCall := &ClientCall{
+		Context: context.Background(),
+		Address: serverAddress,
+		Service: service,
+		Method:  method,
+		Args:    args,
+		Reply:   reply,
+	}
+	this.RLock()
+	clientCall.Caller = this.caller
+	invoker, intercepted := this.invoker, len(this.interceptors) > 0
+	this.RUnlock()
+	if intercepted {
+		// the interceptors wrap the synchronous invocation
+		go func() {
+			call.finish(invoker(clientCall))
+		}()
+		return call
+	}
+	call.client = this
+	call.netOptions = this.getNetOptions(service, method)
+	call.cp = this.getConnPool(serverAddress)
+	rpcConn, err := call.cp.Conn(call.netOptions.connectTimeout, false)
+	if err != nil {
+		call.finish(err)
+		return call
+	}
+	call.request = newCallRequest(clientCall, call.netOptions)
+	call.presp = NewPendingResponse()
+	call.presp.reply = reply
+	call.presp.call = call
+	call.timerLock.Lock()
+	call.timer = time.AfterFunc(call.netOptions.readTimeout+call.netOptions.writeTimeout, call.timeout)
+	call.timerLock.Unlock()
+	call.send(rpcConn)
+	return call
+}
+
+func newCall(service, method string, args interface{}, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		// the call completes on the read goroutine of the connection, it can not block
+		log.Panic("gorpc: done channel is unbuffered")
+	}
+	return &Call{Service: service, Method: method, Args: args, Reply: reply, Done: done}
+}
+
+func (call *Call) send(rpcConn *ConnDriver) {
+	call.timerLock.Lock()
+	if call.timedOut {
+		// timed out while waiting to retry
+		call.timerLock.Unlock()
+		call.finish(ErrRequestTimeout)
+		return
+	}
+	call.conn = rpcConn
+	err := call.client.transfer(rpcConn, call.request, call.presp)
+	call.timerLock.Unlock()
+	if err != nil {
+		call.result(err)
+	}
+}
+
+// the response is received, called by the read goroutine of the connection
+func (call *Call) complete(presp *PendingResponse) {
+	err := presp.err
+	presp.err = nil
+	call.result(err)
+}
+
+// retry once after the error can retry, as the synchronous call
+func (call *Call) result(err *Error) {
+	if err != nil && CanRetry(err) && call.retries < CALL_RETRY_TIMES && atomic.LoadInt32(&call.state) == 0 {
+		call.retries++
+		time.AfterFunc(time.Millisecond*5, call.retry)
+		return
+	}
+	call.finish(err)
+}
+
+func (call *Call) retry() {
+	rpcConn, err := call.cp.Conn(call.netOptions.connectTimeout, true)
+	if err != nil {
+		call.finish(err)
+		return
+	}
+	call.send(rpcConn)
+}
+
+// overload of server will cause timeout. the response taken by the read goroutine
+// is decoding into Reply, the call is completed by it instead
+func (call *Call) timeout() {
+	call.timerLock.Lock()
+	call.timedOut = true
+	removed := false
+	if call.conn != nil {
+		call.conn.Lock()
+		removed = call.conn.RemovePendingResponse(call.presp.seq) != nil
+		call.conn.Unlock()
+	}
+	call.timerLock.Unlock()
+	call.request.freePending()
+	if removed {
+		call.finish(ErrRequestTimeout)
+	}
+}
+
+// the first result completes the call, the late response after the timeout is dropped
+func (call *Call) finish(err *Error) {
+	if !atomic.CompareAndSwapInt32(&call.state, 0, 1) {
+		return
+	}
+	call.timerLock.Lock()
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+	call.timerLock.Unlock()
+	call.Error = err
+	select {
+	case call.Done <- call:
+	default:
+		// the done channel shared by too many calls
+		log.Println("gorpc: discarding Call reply due to insufficient Done chan capacity")
+	}
+}
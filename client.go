@@ -6,6 +6,8 @@
 package gorpc
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"math/rand"
 	"sync"
@@ -22,20 +24,85 @@ type NetOptions struct {
 	connectTimeout time.Duration
 	readTimeout    time.Duration
 	writeTimeout   time.Duration
+	compress       int8
 }
 
 func NewNetOptions(connectTimeout, readTimeOut, writeTimeout time.Duration) *NetOptions {
-	return &NetOptions{connectTimeout, readTimeOut, writeTimeout}
+	return &NetOptions{connectTimeout: connectTimeout, readTimeout: readTimeOut, writeTimeout: writeTimeout}
+}
+
+// compression mode of the requests and the replies, CompressDefault compresses
+// the bodies not smaller than the threshold if the connection negotiated compression
+func (no *NetOptions) SetCompress(mode int8) *NetOptions {
+	no.compress = mode
+	return no
 }
 
 type ServerOptions struct {
-	address      string
-	maxOpenConns int
-	maxIdleConns int
+	address         string
+	maxOpenConns    int
+	maxIdleConns    int
+	codec           Codec
+	maxResponseSize int
+	tlsConfig       *tls.Config
+	dialer          Dialer
+	compressions    []string
+	compressMin     int
+	token           string
+	coalesceBytes   int
+	coalesceDelay   time.Duration
 }
 
+// serverAddress is host:port, or the unix socket path with prefix "unix://"
 func NewServerOptions(serverAddress string, maxOpenConns, maxIdleConns int) *ServerOptions {
-	return &ServerOptions{serverAddress, maxOpenConns, maxIdleConns}
+	return &ServerOptions{address: serverAddress, maxOpenConns: maxOpenConns, maxIdleConns: maxIdleConns}
+}
+
+// codec used by the connections to the server, gob by default
+func (so *ServerOptions) SetCodec(codec Codec) *ServerOptions {
+	so.codec = codec
+	return so
+}
+
+// max body size of the responses from the server, DefaultMaxResponseSize by default
+func (so *ServerOptions) SetMaxResponseSize(size int) *ServerOptions {
+	so.maxResponseSize = size
+	return so
+}
+
+// connect the server over tls. set Certificates or GetClientCertificate of config
+// for the server verifying the client certificates
+func (so *ServerOptions) SetTLSConfig(config *tls.Config) *ServerOptions {
+	so.tlsConfig = config
+	return so
+}
+
+// compress the bodies not smaller than threshold with the first of names supported
+// by the server, such as "snappy" and "gzip". no compression by default
+func (so *ServerOptions) SetCompressions(threshold int, names ...string) *ServerOptions {
+	so.compressMin = threshold
+	so.compressions = names
+	return so
+}
+
+// credentials sent in the handshake of the connections, checked by the Authenticator of the server
+func (so *ServerOptions) SetToken(token string) *ServerOptions {
+	so.token = token
+	return so
+}
+
+// flush the requests up to maxBytes together, a request waits up to maxDelay for more.
+// the requests queued while writing are flushed together even without delay
+func (so *ServerOptions) SetWriteCoalesce(maxBytes int, maxDelay time.Duration) *ServerOptions {
+	so.coalesceBytes = maxBytes
+	so.coalesceDelay = maxDelay
+	return so
+}
+
+// connect the server by dialer, such as PipeListener.Dial for the in-memory transport
+func (so *ServerOptions) SetDialer(dialer Dialer) *ServerOptions {
+	so.dialer = dialer
+	return so
 }
 
 type Client struct {
@@ -45,6 +112,9 @@ type Client struct {
 	serviceOptions map[string]*NetOptions
 	methodOptions  map[string]map[string]*NetOptions
 	serverOptions  *NetOptions
+	interceptors   []ClientInterceptor
+	caller         string
+	invoker        ClientInvoker // interceptors chained with the call
 }
 
 func NewClient(netOptions *NetOptions) *Client {
@@ -54,6 +124,7 @@ func NewClient(netOptions *NetOptions) *Client {
 		serviceOptions: make(map[string]*NetOptions),
 		methodOptions:  make(map[string]map[string]*NetOptions),
 	}
+	c.invoker = c.invoke
 	return &c
 }
 
@@ -66,9 +137,53 @@ func (this *Client) AddServers(servers []*ServerOptions) *ConnPool {
 			cp.Lock()
 			cp.maxOpenConns = server.maxOpenConns
 			cp.maxIdleConns = server.maxIdleConns
+			if server.codec != nil {
+				cp.codec = server.codec
+			}
+			if server.maxResponseSize > 0 {
+				cp.maxResponseSize = server.maxResponseSize
+			}
+			if server.tlsConfig != nil {
+				cp.tlsConfig = server.tlsConfig
+			}
+			if server.dialer != nil {
+				cp.dialer = server.dialer
+			}
+			if server.compressions != nil {
+				cp.compressMin = server.compressMin
+				cp.compressions = server.compressions
+			}
+			if server.token != "" {
+				cp.token = server.token
+			}
+			if server.coalesceBytes > 0 {
+				cp.coalesceBytes = server.coalesceBytes
+				cp.coalesceDelay = server.coalesceDelay
+			}
 			cp.Unlock()
 		} else {
 			cp = NewConnPool(server.address, server.maxOpenConns, server.maxIdleConns)
+			if server.codec != nil {
+				cp.SetCodec(server.codec)
+			}
+			if server.maxResponseSize > 0 {
+				cp.SetMaxResponseSize(server.maxResponseSize)
+			}
+			if server.tlsConfig != nil {
+				cp.SetTLSConfig(server.tlsConfig)
+			}
+			if server.dialer != nil {
+				cp.SetDialer(server.dialer)
+			}
+			if server.compressions != nil {
+				cp.SetCompressions(server.compressMin, server.compressions...)
+			}
+			if server.token != "" {
+				cp.SetToken(server.token)
+			}
+			if server.coalesceBytes > 0 {
+				cp.SetWriteCoalesce(server.coalesceBytes, server.coalesceDelay)
+			}
 			cp.client = this
 			this.cpMap[server.address] = cp
 			this.addressSlice = append(this.addressSlice, server.address)
@@ -94,6 +209,14 @@ func (this *Client) RemoveServers(addresses map[string]struct{}) {
 	this.Unlock()
 }
 
+// identity sent with every call for the authorization of the server, not verified by the
+// server, use the token of ServerOptions.SetToken if the identity must be authenticated
+func (this *Client) SetCaller(caller string) {
+	this.Lock()
+	this.caller = caller
+	this.Unlock()
+}
+
 func (this *Client) SetServerNetOptions(netOptions *NetOptions) error {
 	this.Lock()
 	this.serverOptions = netOptions
@@ -120,47 +243,67 @@ func (this *Client) SetMethodNetOptinons(service, method string, netOptions *Net
 
 // set reply to nil means server send response immediately before execute service.method
 func (this *Client) Call(service, method string, args interface{}, reply interface{}) *Error {
+	return this.CallContext(context.Background(), service, method, args, reply)
+}
+
+// Call with ctx, the call returns ErrRequestCanceled once ctx is done
+func (this *Client) CallContext(ctx context.Context, service, method string, args interface{}, reply interface{}) *Error {
 	serverAddress, err := this.getAddress()
 	if err != nil {
 		return err
 	}
-	return this.CallWithAddress(serverAddress, service, method, args, reply)
+	return this.CallWithAddressContext(ctx, serverAddress, service, method, args, reply)
 }
 
 // set reply to nil means server send response immediately then exec  service.method
 func (this *Client) CallWithAddress(serverAddress, service, method string, args interface{}, reply interface{}) *Error {
+	return this.CallWithAddressContext(context.Background(), serverAddress, service, method, args, reply)
+}
+
+// CallWithAddress with ctx, the call returns ErrRequestCanceled once ctx is done.
+// the request is dropped if it is still waiting to be written to the connection
+func (this *Client) CallWithAddressContext(ctx context.Context, serverAddress, service, method string, args interface{}, reply interface{}) *Error {
 	if serverAddress == "" {
 		return ErrInvalidAddress.SetReason("client remote address is empty")
 	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ErrRequestCanceled.SetError(ctxErr)
+	}
+	call := &ClientCall{
+		Context: ctx,
+		Address: serverAddress,
+		Service: service,
+		Method:  method,
+		Args:    args,
+		Reply:   reply,
+	}
+	this.RLock()
+	invoker := this.invoker
+	call.Caller = this.caller
+	this.RUnlock()
+	return invoker(call)
+}
+
+// send the call to the server and wait for the response, retry once if the error can retry
+func (this *Client) invoke(call *ClientCall) *Error {
 	var (
 		err     *Error
 		rpcConn *ConnDriver
 		presp   *PendingResponse
 		request *Request
+		ctx     = call.Context
 	)
-	connectTimeout, readTimeout, writeTimeout := this.getTimeout(service, method)
-	this.RLock()
-	cp, ok := this.cpMap[serverAddress]
-	this.RUnlock()
-	if !ok {
-		cp = this.AddServers([]*ServerOptions{NewServerOptions(serverAddress, DefaultMaxOpenConns, DefaultMaxIdleConns)})
-	}
+	netOptions := this.getNetOptions(call.Service, call.Method)
+	connectTimeout, readTimeout, writeTimeout := netOptions.connectTimeout, netOptions.readTimeout, netOptions.writeTimeout
+	cp := this.getConnPool(call.Address)
 	rpcConn, err = cp.Conn(connectTimeout, false)
 	if err != nil {
 		return err
 	}
-	// init request
-	request = NewRequest()
-	request.header.Service = service
-	request.header.Method = method
-	if reply == nil {
-		request.header.CallType = RequestSendOnly
-	}
-	request.body = args
-	request.writeTimeout = writeTimeout
+	request = newCallRequest(call, netOptions)
 	// init pending response
 	presp = NewPendingResponse()
-	presp.reply = reply
+	presp.reply = call.Reply
 	retryTimes := 0
 	timer := timewheel.NewTimer(readTimeout + writeTimeout)
 Retry:
@@ -171,9 +314,13 @@ Retry:
 	select {
 	// overload of server will cause timeout
 	case <-timer.C:
-		request.freePending()
+		this.abandon(rpcConn, request, presp)
 		err = ErrRequestTimeout
 		goto final
+	case <-ctx.Done():
+		this.abandon(rpcConn, request, presp)
+		err = ErrRequestCanceled.SetError(ctx.Err())
+		return err
 	case <-presp.done:
 		if presp.err == nil {
 			goto final
@@ -198,12 +345,12 @@ final:
 	}
 	time.Sleep(time.Millisecond * 5)
 	retryTimes++
+	call.Retries = retryTimes
 	if rpcConn, err = cp.Conn(connectTimeout, true); err != nil {
 		// can free request/presp object
 		return err
 	}
 	goto Retry
-	return nil
 }
 
 // connections status statistics
@@ -264,6 +411,26 @@ func (this *Client) Qps() string {
 	return string(result)
 }
 
+// init the request of the call, the caller stops waiting after the timeouts or the deadline of ctx
+func newCallRequest(call *ClientCall, netOptions *NetOptions) *Request {
+	request := NewRequest()
+	request.header.Service = call.Service
+	request.header.Method = call.Method
+	request.header.Meta = call.Meta
+	request.header.Caller = call.Caller
+	request.header.Compress = netOptions.compress
+	if call.Reply == nil {
+		request.header.CallType = RequestSendOnly
+	}
+	request.body = call.Args
+	request.writeTimeout = netOptions.writeTimeout
+	request.deadline = time.Now().Add(netOptions.readTimeout + netOptions.writeTimeout)
+	if ctxDeadline, ok := call.Context.Deadline(); ok && ctxDeadline.Before(request.deadline) {
+		request.deadline = ctxDeadline
+	}
+	return request
+}
+
 func (this *Client) transfer(rpcConn *ConnDriver, request *Request, presp *PendingResponse) *Error {
 	var (
 		sequence uint64
@@ -294,6 +461,19 @@ fail:
 	return ErrUnknow.SetError(err)
 }
 
+// stop waiting for the response, return false if the read goroutine has taken it.
+// the reply may be decoding then, it is waited for as the reply can not be touched after return
+func (this *Client) abandon(rpcConn *ConnDriver, request *Request, presp *PendingResponse) bool {
+	rpcConn.Lock()
+	removed := rpcConn.RemovePendingResponse(presp.seq) != nil
+	rpcConn.Unlock()
+	request.freePending()
+	if !removed {
+		<-presp.done
+	}
+	return removed
+}
+
 func (this *Client) writePing(rpcConn *ConnDriver) error {
 	// init request
 	request := NewRequest()
@@ -307,14 +487,14 @@ func (this *Client) writePing(rpcConn *ConnDriver) error {
 	return this.transfer(rpcConn, request, presp)
 }
 
-// get readTimeout writeTimeout
-func (this *Client) getTimeout(service, method string) (time.Duration, time.Duration, time.Duration) {
+// get the net options of the method, the service or the server in order
+func (this *Client) getNetOptions(service, method string) *NetOptions {
 	this.RLock()
 	var netOption *NetOptions
 	if netOption = this.methodOptions[service][method]; netOption != nil {
 		this.RUnlock()
 		// println("service method")
-		return netOption.connectTimeout, netOption.readTimeout, netOption.writeTimeout
+		return netOption
 	}
 	if netOption = this.serviceOptions[service]; netOption != nil {
 		this.RUnlock()
@@ -336,7 +516,18 @@ final:
 		this.methodOptions[service] = option
 	}
 	this.Unlock()
-	return netOption.connectTimeout, netOption.readTimeout, netOption.writeTimeout
+	return netOption
+}
+
+// get the pool of the address, added with the default options if not found
+func (this *Client) getConnPool(address string) *ConnPool {
+	this.RLock()
+	cp, ok := this.cpMap[address]
+	this.RUnlock()
+	if !ok {
+		cp = this.AddServers([]*ServerOptions{NewServerOptions(address, DefaultMaxOpenConns, DefaultMaxIdleConns)})
+	}
+	return cp
 }
 
 func (this *Client) getAddress() (string, *Error) {
@@ -0,0 +1,113 @@
+package gorpc
+
+import (
+	"encoding/gob"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// codec id, the client sends it to identify the codec of the connection
+const (
+	GobCodec = 1
+)
+
+// Codec serializes request/response headers and bodies on a connection.
+// every connection gets its own Encoder and Decoder, they may keep the state of the stream.
+// the connection frames the values, the Decoder reads from a reader holding exactly one value
+type Codec interface {
+	Id() int
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decode(nil) must consume and discard the next value
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// implemented by the codecs which can serialize only some types,
+// the server refuses to register methods whose args or reply fail the validation
+type TypeValidator interface {
+	ValidateType(t reflect.Type) error
+}
+
+// implemented by the codecs whose decoder keeps state between values,
+// such as gob sending a type definition only once. after a value is skipped
+// without decoding, the connection of a stateful codec must be closed
+type StatefulCodec interface {
+	Stateful() bool
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[int]Codec
+}{m: make(map[int]Codec)}
+
+// CodecError is returned by the codecs when a value can not be serialized,
+// it tells the serialization errors from the errors of the connection
+type CodecError struct {
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	return e.Err.Error()
+}
+
+func asCodecError(err error) error {
+	if _, ok := err.(*CodecError); ok {
+		return err
+	}
+	return &CodecError{err}
+}
+
+// register codec so that server can find the codec by the id sent by client
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	codecs.m[codec.Id()] = codec
+	codecs.Unlock()
+}
+
+// return nil if codec not registered
+func CodecById(id int) Codec {
+	codecs.RLock()
+	codec := codecs.m[id]
+	codecs.RUnlock()
+	return codec
+}
+
+func init() {
+	RegisterCodec(NewGobCodec())
+}
+
+type gobCodec struct{}
+
+// the default codec
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) Id() int {
+	return GobCodec
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+func (gobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
+
+func (gobCodec) Stateful() bool {
+	return true
+}
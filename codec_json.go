@@ -0,0 +1,65 @@
+package gorpc
+
+import (
+	"encoding/json"
+	"io"
+)
+
+const (
+	JsonCodec = 2
+)
+
+func init() {
+	RegisterCodec(NewJsonCodec())
+}
+
+// headers and bodies are json text, easy to read from tcpdump and to implement in other languages
+type jsonCodec struct{}
+
+func NewJsonCodec() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) Id() int {
+	return JsonCodec
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{w: w}
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return &jsonDecoder{r: r}
+}
+
+type jsonEncoder struct {
+	w io.Writer
+}
+
+func (enc *jsonEncoder) Encode(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return &CodecError{err}
+	}
+	_, err = enc.w.Write(data)
+	return err
+}
+
+type jsonDecoder struct {
+	r io.Reader
+}
+
+func (dec *jsonDecoder) Decode(v interface{}) error {
+	data, err := readSegment(dec.r)
+	if err != nil || v == nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return &CodecError{err}
+	}
+	return nil
+}
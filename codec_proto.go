@@ -0,0 +1,398 @@
+package gorpc
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	ProtoCodec = 3
+)
+
+var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+func init() {
+	RegisterCodec(NewProtoCodec())
+}
+
+// args and replies must be proto.Message or builtin scalars which are sent as
+// the well-known wrapper messages (google.protobuf.Int64Value etc.).
+// headers are encoded as the messages below:
+//
+//	message RequestHeader {
+//		string service = 1; string method = 2; uint64 seq = 3;
+//		int32 call_type = 4; int64 timeout = 5; map<string, string> meta = 6;
+//		int32 compress = 7; string caller = 8; uint32 window = 9;
+//	}
+//	message Error { int64 code = 1; int64 type = 2; string reason = 3; }
+//	message ResponseHeader { Error error = 1; uint64 seq = 2; int32 reply_type = 3; uint32 window = 4; }
+type protoCodec struct{}
+
+func NewProtoCodec() Codec {
+	return protoCodec{}
+}
+
+func (protoCodec) Id() int {
+	return ProtoCodec
+}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) NewEncoder(w io.Writer) Encoder {
+	return &protoEncoder{w: w}
+}
+
+func (protoCodec) NewDecoder(r io.Reader) Decoder {
+	return &protoDecoder{r: r}
+}
+
+// args must be a proto message pointer or a scalar, reply a pointer to either
+func (protoCodec) ValidateType(t reflect.Type) error {
+	if t.Implements(typeOfProtoMessage) {
+		return nil
+	}
+	if isProtoScalar(t) || (t.Kind() == reflect.Ptr && isProtoScalar(t.Elem())) {
+		return nil
+	}
+	if reflect.PtrTo(t).Implements(typeOfProtoMessage) {
+		return fmt.Errorf("proto: use pointer of message %s", t)
+	}
+	return fmt.Errorf("proto: type %s is not a proto.Message", t)
+}
+
+func isProtoScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+type protoEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (enc *protoEncoder) Encode(v interface{}) error {
+	var err error
+	buf := enc.buf[:0]
+	switch value := v.(type) {
+	case *RequestHeader:
+		buf = appendRequestHeader(buf, value)
+	case *ResponseHeader:
+		buf = appendResponseHeader(buf, value)
+	default:
+		var m proto.Message
+		if m, err = toProtoMessage(v); err != nil {
+			return &CodecError{err}
+		}
+		if buf, err = (proto.MarshalOptions{}).MarshalAppend(buf, m); err != nil {
+			return &CodecError{err}
+		}
+	}
+	enc.buf = buf
+	_, err = enc.w.Write(buf)
+	return err
+}
+
+type protoDecoder struct {
+	r io.Reader
+}
+
+func (dec *protoDecoder) Decode(v interface{}) error {
+	data, err := readSegment(dec.r)
+	if err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case *RequestHeader:
+		err = consumeRequestHeader(data, value)
+	case *ResponseHeader:
+		err = consumeResponseHeader(data, value)
+	case proto.Message:
+		err = proto.Unmarshal(data, value)
+	default:
+		err = unmarshalScalar(data, v)
+	}
+	if err != nil {
+		return &CodecError{err}
+	}
+	return nil
+}
+
+// wrap scalars with the well-known wrapper messages
+func toProtoMessage(v interface{}) (proto.Message, error) {
+	if m, ok := v.(proto.Message); ok {
+		return m, nil
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return wrapperspb.Bool(rv.Bool()), nil
+	case reflect.String:
+		return wrapperspb.String(rv.String()), nil
+	case reflect.Float32:
+		return wrapperspb.Float(float32(rv.Float())), nil
+	case reflect.Float64:
+		return wrapperspb.Double(rv.Float()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return wrapperspb.Int64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return wrapperspb.UInt64(rv.Uint()), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return wrapperspb.Bytes(rv.Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("proto: can not encode type %T", v)
+}
+
+// v must be a pointer to scalar
+func unmarshalScalar(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("proto: can not decode into type %T", v)
+	}
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	var err error
+	switch rv.Kind() {
+	case reflect.Bool:
+		m := &wrapperspb.BoolValue{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetBool(m.Value)
+		}
+	case reflect.String:
+		m := &wrapperspb.StringValue{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetString(m.Value)
+		}
+	case reflect.Float32:
+		m := &wrapperspb.FloatValue{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetFloat(float64(m.Value))
+		}
+	case reflect.Float64:
+		m := &wrapperspb.DoubleValue{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetFloat(m.Value)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		m := &wrapperspb.Int64Value{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetInt(m.Value)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		m := &wrapperspb.UInt64Value{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetUint(m.Value)
+		}
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("proto: can not decode into type %T", v)
+		}
+		m := &wrapperspb.BytesValue{}
+		if err = proto.Unmarshal(data, m); err == nil {
+			rv.SetBytes(m.Value)
+		}
+	default:
+		return fmt.Errorf("proto: can not decode into type %T", v)
+	}
+	return err
+}
+
+func appendRequestHeader(b []byte, h *RequestHeader) []byte {
+	b = appendString(b, 1, h.Service)
+	b = appendString(b, 2, h.Method)
+	b = appendVarint(b, 3, h.Seq)
+	b = appendVarint(b, 4, uint64(h.CallType))
+	b = appendVarint(b, 5, uint64(h.Timeout))
+	for k, v := range h.Meta {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, v)
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendVarint(b, 7, uint64(h.Compress))
+	b = appendString(b, 8, h.Caller)
+	b = appendVarint(b, 9, uint64(h.Window))
+	return b
+}
+
+func consumeRequestHeader(b []byte, h *RequestHeader) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeString(b, &h.Service)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &h.Method)
+		case num == 3 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Seq = v })
+		case num == 4 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.CallType = int16(v) })
+		case num == 5 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Timeout = int64(v) })
+		case num == 6 && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			if h.Meta == nil {
+				h.Meta = make(map[string]string)
+			}
+			return n, consumeMetaEntry(entry, h.Meta)
+		case num == 7 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Compress = int8(v) })
+		case num == 8 && typ == protowire.BytesType:
+			return consumeString(b, &h.Caller)
+		case num == 9 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Window = uint32(v) })
+		}
+		return -1, nil
+	})
+}
+
+func consumeMetaEntry(b []byte, meta map[string]string) error {
+	var k, v string
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeString(b, &k)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &v)
+		}
+		return -1, nil
+	})
+	meta[k] = v
+	return err
+}
+
+func appendResponseHeader(b []byte, h *ResponseHeader) []byte {
+	if h.Error != nil {
+		var e []byte
+		e = appendVarint(e, 1, uint64(h.Error.Code))
+		e = appendVarint(e, 2, uint64(h.Error.Type))
+		e = appendString(e, 3, h.Error.Reason)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	b = appendVarint(b, 2, h.Seq)
+	b = appendVarint(b, 3, uint64(h.ReplyType))
+	b = appendVarint(b, 4, uint64(h.Window))
+	return b
+}
+
+func consumeResponseHeader(b []byte, h *ResponseHeader) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			e, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			h.Error = &Error{}
+			return n, consumeError(e, h.Error)
+		case num == 2 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Seq = v })
+		case num == 3 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.ReplyType = int16(v) })
+		case num == 4 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { h.Window = uint32(v) })
+		}
+		return -1, nil
+	})
+}
+
+func consumeError(b []byte, e *Error) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { e.Code = int(int64(v)) })
+		case num == 2 && typ == protowire.VarintType:
+			return consumeVarint(b, func(v uint64) { e.Type = int(int64(v)) })
+		case num == 3 && typ == protowire.BytesType:
+			return consumeString(b, &e.Reason)
+		}
+		return -1, nil
+	})
+}
+
+// zero values are omitted as proto3 does
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func consumeString(b []byte, s *string) (int, error) {
+	v, n := protowire.ConsumeString(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*s = v
+	return n, nil
+}
+
+func consumeVarint(b []byte, set func(uint64)) (int, error) {
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	set(v)
+	return n, nil
+}
+
+// field consumes the value of a known field and returns its length,
+// or -1 to skip an unknown field
+func consumeFields(b []byte, field func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package gorpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// compression mode of a call, set by NetOptions.SetCompress
+const (
+	// compress the body larger than the threshold of the connection
+	CompressDefault int8 = iota
+	CompressNever
+	// compress the body regardless of the threshold
+	CompressAlways
+)
+
+// Compressor compresses the bodies of the frames, the name is negotiated in the handshake
+type Compressor interface {
+	Name() string
+	Compress(dst *bytes.Buffer, src []byte) error
+	// return errDecompressTooLarge if the decompressed data exceeds maxSize
+	Decompress(dst *bytes.Buffer, src []byte, maxSize int) error
+}
+
+var errDecompressTooLarge = errors.New("gorpc: decompressed body too large")
+
+var compressors = struct {
+	sync.RWMutex
+	m map[string]Compressor
+}{m: make(map[string]Compressor)}
+
+// register compressor so that it can be negotiated by name
+func RegisterCompressor(compressor Compressor) {
+	compressors.Lock()
+	compressors.m[compressor.Name()] = compressor
+	compressors.Unlock()
+}
+
+// return nil if compressor not registered
+func CompressorByName(name string) Compressor {
+	compressors.RLock()
+	compressor := compressors.m[name]
+	compressors.RUnlock()
+	return compressor
+}
+
+// the first of names registered, nil if none
+func negotiateCompressor(names []string) Compressor {
+	for _, name := range names {
+		if compressor := CompressorByName(name); compressor != nil {
+			return compressor
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(&gzipCompressor{})
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(dst *bytes.Buffer, src []byte) error {
+	dst.Write(snappy.Encode(unusedBytes(dst, snappy.MaxEncodedLen(len(src))), src))
+	return nil
+}
+
+func (snappyCompressor) Decompress(dst *bytes.Buffer, src []byte, maxSize int) error {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		return errDecompressTooLarge
+	}
+	b, err := snappy.Decode(unusedBytes(dst, n), src)
+	if err != nil {
+		return err
+	}
+	dst.Write(b)
+	return nil
+}
+
+// the unused capacity of buf grown to n bytes, written by snappy without allocating
+func unusedBytes(buf *bytes.Buffer, n int) []byte {
+	buf.Grow(n)
+	b := buf.Bytes()
+	return b[len(b) : len(b)+n]
+}
+
+// the writers and readers are reused, they are costly to allocate
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (*gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(dst *bytes.Buffer, src []byte) error {
+	w, _ := c.writers.Get().(*gzip.Writer)
+	if w == nil {
+		w = gzip.NewWriter(dst)
+	} else {
+		w.Reset(dst)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *gzipCompressor) Decompress(dst *bytes.Buffer, src []byte, maxSize int) error {
+	r, _ := c.readers.Get().(*gzip.Reader)
+	var err error
+	if r == nil {
+		r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return err
+	}
+	defer c.readers.Put(r)
+	n, err := io.Copy(dst, io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return err
+	}
+	if n > int64(maxSize) {
+		return errDecompressTooLarge
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package gorpc
 
 import (
 	"container/list"
+	"crypto/tls"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,33 +12,104 @@ import (
 const (
 	TimeWheelBucketSize = 600
 	TimeWheelInterval   = time.Second
+	// server address of the unix socket, such as unix:///var/run/gorpc.sock
+	UnixAddressPrefix = "unix://"
 )
 
 type ConnPool struct {
-	address       string
-	sync.Mutex    // protects following fields
-	openConnsPool *OpensPool
-	maxOpenConns  int
-	maxIdleConns  int
-	creatingConns int
-	client        *Client
-	status        *ClientStatus
+	address         string
+	sync.Mutex      // protects following fields
+	openConnsPool   *OpensPool
+	maxOpenConns    int
+	maxIdleConns    int
+	creatingConns   int
+	codec           Codec
+	maxResponseSize int
+	tlsConfig       *tls.Config
+	dialer          Dialer
+	compressions    []string // in preference order, none if empty
+	compressMin     int
+	token           string
+	coalesceBytes   int
+	coalesceDelay   time.Duration
+	client          *Client
+	status          *ClientStatus
 }
 
 // new connection pool and start async-ping goroutine and timer-garbage-collect goroutine
 func NewConnPool(address string, maxOpenConns, maxIdleConns int) *ConnPool {
 	cp := &ConnPool{
-		openConnsPool: NewOpenPool(),
-		maxOpenConns:  maxOpenConns,
-		maxIdleConns:  maxIdleConns,
-		address:       address,
-		status:        &ClientStatus{},
+		openConnsPool:   NewOpenPool(),
+		maxOpenConns:    maxOpenConns,
+		maxIdleConns:    maxIdleConns,
+		address:         address,
+		codec:           NewGobCodec(),
+		maxResponseSize: DefaultMaxResponseSize,
+		compressMin:     DefaultCompressThreshold,
+		coalesceBytes:   DefaultWriteCoalesceBytes,
+		status:          &ClientStatus{},
 	}
 	go cp.ServeIdlePing()
 	go cp.GCTimer()
 	return cp
 }
 
+// codec used by the connections created afterwards
+func (cp *ConnPool) SetCodec(codec Codec) {
+	cp.Lock()
+	cp.codec = codec
+	cp.Unlock()
+}
+
+// the response whose body exceeds size is failed with ErrResponseTooLarge without decoding
+func (cp *ConnPool) SetMaxResponseSize(size int) {
+	cp.Lock()
+	cp.maxResponseSize = size
+	cp.Unlock()
+}
+
+// the connections created afterwards compress the requests not smaller than threshold
+// with the first of names supported by the server
+func (cp *ConnPool) SetCompressions(threshold int, names ...string) {
+	cp.Lock()
+	cp.compressMin = threshold
+	cp.compressions = names
+	cp.Unlock()
+}
+
+// the token sent in the handshake of the connections created afterwards
+func (cp *ConnPool) SetToken(token string) {
+	cp.Lock()
+	cp.token = token
+	cp.Unlock()
+}
+
+// Dialer connects the server at address, such as PipeListener.Dial
+type Dialer func(address string, connectTimeout time.Duration) (net.Conn, error)
+
+// connections are created by dialer instead of dialing the network
+func (cp *ConnPool) SetDialer(dialer Dialer) {
+	cp.Lock()
+	cp.dialer = dialer
+	cp.Unlock()
+}
+
+// the connections created afterwards flush the requests up to maxBytes together,
+// a request waits up to maxDelay for more. DefaultWriteCoalesceBytes and no delay by default
+func (cp *ConnPool) SetWriteCoalesce(maxBytes int, maxDelay time.Duration) {
+	cp.Lock()
+	cp.coalesceBytes = maxBytes
+	cp.coalesceDelay = maxDelay
+	cp.Unlock()
+}
+
+// connect the server over tls if config is not nil
+func (cp *ConnPool) SetTLSConfig(config *tls.Config) {
+	cp.Lock()
+	cp.tlsConfig = config
+	cp.Unlock()
+}
+
 func (cp *ConnPool) poolStatus() *ClientStatus {
 	cp.Lock()
 	workingAmount := cp.openConnsPool.workingList.Len()
@@ -51,18 +124,64 @@ func (cp *ConnPool) poolStatus() *ClientStatus {
 	}
 }
 
-func (cp *ConnPool) connect(address string, connectTimeout time.Duration) (*net.TCPConn, error) {
-	c, err := net.DialTimeout("tcp", address, connectTimeout)
-	if err != nil {
+// the address with prefix "unix://" is a unix socket path.
+// the tls handshake is finished within connectTimeout too
+func (cp *ConnPool) connect(address string, connectTimeout time.Duration, tlsConfig *tls.Config, dialer Dialer) (net.Conn, error) {
+	if dialer == nil {
+		network := "tcp"
+		if strings.HasPrefix(address, UnixAddressPrefix) {
+			network, address = "unix", strings.TrimPrefix(address, UnixAddressPrefix)
+		}
+		if tlsConfig != nil {
+			return tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, network, address, tlsConfig)
+		}
+		return net.DialTimeout(network, address, connectTimeout)
+	}
+	conn, err := dialer(address, connectTimeout)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(connectTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return c.(*net.TCPConn), nil
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 func (cp *ConnPool) createConn(connectTimeout time.Duration) (*ConnDriver, *Error) {
-	conn, err := cp.connect(cp.address, connectTimeout)
+	cp.Lock()
+	codec, maxResponseSize, tlsConfig, dialer := cp.codec, cp.maxResponseSize, cp.tlsConfig, cp.dialer
+	compressions, compressMin, token := cp.compressions, cp.compressMin, cp.token
+	coalesceBytes, coalesceDelay := cp.coalesceBytes, cp.coalesceDelay
+	cp.Unlock()
+	conn, err := cp.connect(cp.address, connectTimeout, tlsConfig, dialer)
+	var reply *Handshake
+	if err == nil {
+		reply, err = clientHandshake(conn, &Handshake{
+			Version:      HandshakeVersion,
+			Codec:        codec.Id(),
+			Compressions: compressions,
+			MaxFrameSize: maxResponseSize,
+			Features:     SupportedFeatures,
+			Token:        token,
+		}, connectTimeout)
+		if err != nil {
+			conn.Close()
+		}
+	}
 	if err == nil {
-		var rpcConn *ConnDriver = NewConnDriver(conn, nil)
+		var rpcConn *ConnDriver = NewConnDriver(conn, nil, codec)
+		rpcConn.maxBodySize = maxResponseSize
+		rpcConn.peerMaxBodySize = reply.MaxFrameSize
+		rpcConn.features = reply.Features
+		if len(reply.Compressions) > 0 {
+			rpcConn.compressor = CompressorByName(reply.Compressions[0])
+			rpcConn.compressMin = compressMin
+		}
+		rpcConn.setWriteCoalesce(coalesceBytes, coalesceDelay)
 		rpcConn.connId = clientConnId.Incr()
 		go cp.serveRead(rpcConn)
 		go cp.serveWrite(rpcConn)
@@ -75,6 +194,10 @@ func (cp *ConnPool) createConn(connectTimeout time.Duration) (*ConnDriver, *Erro
 	cp.Lock()
 	cp.creatingConns--
 	cp.Unlock()
+	// rejected by the server
+	if e, ok := err.(*Error); ok {
+		return nil, e
+	}
 	return nil, ErrNetConnectFail.SetReason(err.Error())
 }
 
@@ -174,31 +297,71 @@ func (cp *ConnPool) serveRead(rpcConn *ConnDriver) {
 			break
 		}
 		cp.status.IncreReadAmount()
+		if respHeader.ReplyType == ReplyTypeGoAway {
+			// server is shutting down, keep reading the pending responses
+			// but stop handing out this connection
+			cp.Lock()
+			rpcConn.Lock()
+			rpcConn.goAway = true
+			cp.RemoveConn(rpcConn)
+			rpcConn.Unlock()
+			cp.Unlock()
+			continue
+		}
 		rpcConn.Lock()
-		pendingResponse := rpcConn.RemovePendingResponse(respHeader.Seq)
+		pendingResponse := rpcConn.pendingResponses[respHeader.Seq]
+		// the stream stays pending until its end
+		if pendingResponse == nil || pendingResponse.stream == nil || !respHeader.isStreamFrame() {
+			pendingResponse = rpcConn.RemovePendingResponse(respHeader.Seq)
+		}
 		rpcConn.Unlock()
 		if respHeader.ReplyType == ReplyTypePong {
 			continue
 		}
+		if pendingResponse == nil {
+			// the stream is closed by the caller, drop the frames left
+			if err = cp.discardResponse(rpcConn, respHeader); err != nil {
+				break
+			}
+			continue
+		}
+		if pendingResponse.stream != nil {
+			if err = cp.readStream(rpcConn, respHeader, pendingResponse.stream); err != nil {
+				break
+			}
+			if respHeader.isStreamFrame() {
+				continue
+			}
+			goto idle
+		}
 		pendingResponse.err = respHeader.Error
 		// @todo  call do not observes this pending response,ReadResponseBody use nil instead of pendingResponse.reply
 		if respHeader.HaveReply() {
 			if err = rpcConn.ReadResponseBody(pendingResponse.reply); err != nil {
-				if isNetError(err) {
+				if e, ok := err.(*Error); ok {
+					// the body is too large and skipped
+					pendingResponse.err = e
+					if rpcConn.isStateful() {
+						pendingResponse.complete()
+						break
+					}
+				} else if isNetError(err) {
 					pendingResponse.err = ErrNetReadFail.SetError(err)
-					pendingResponse.done <- true
+					pendingResponse.complete()
 					break
+				} else {
+					pendingResponse.err = ErrGobParseErr.SetError(err)
 				}
-				pendingResponse.err = ErrGobParseErr.SetError(err)
 			}
 		}
-		pendingResponse.done <- true
+		pendingResponse.complete()
+	idle:
 		cp.Lock()
 		rpcConn.Lock()
 		if rpcConn.netError == nil {
 			rpcConn.lastUseTime = time.Now()
 			rpcConn.callCount++
-			if len(rpcConn.pendingResponses) == 0 {
+			if len(rpcConn.pendingResponses) == 0 && !rpcConn.goAway {
 				cp.MarkAsIdle(rpcConn)
 			}
 		}
@@ -218,16 +381,24 @@ func (cp *ConnPool) serveRead(rpcConn *ConnDriver) {
 	cp.RemoveConn(rpcConn)
 	cp.Unlock()
 	rpcConn.Close()
+	close(rpcConn.done)
 	close(rpcConn.pendingRequests)
 	for _, resp := range rmap {
+		if resp.stream != nil {
+			resp.stream.end(ErrPendingWireBroken)
+			continue
+		}
 		resp.err = ErrPendingWireBroken
-		resp.done <- true
+		resp.complete()
 	}
 }
 
 // serve write connection
 func (cp *ConnPool) serveWrite(rpcConn *ConnDriver) {
-	var err error
+	var (
+		err   error
+		delay <-chan time.Time // flush when it fires, set while waiting for more requests
+	)
 	for {
 		select {
 		case request, ok := <-rpcConn.pendingRequests:
@@ -235,29 +406,41 @@ func (cp *ConnPool) serveWrite(rpcConn *ConnDriver) {
 				err = &Error{500, ErrTypeLogic, "client write channel close"}
 				goto fail
 			}
-			if isPending := request.IsPending(); !isPending {
-				rpcConn.Lock()
-				rpcConn.RemovePendingResponse(request.header.Seq)
-				rpcConn.Unlock()
-				continue
-			}
-			// write request
-			if err = rpcConn.SetWriteDeadline(time.Now().Add(request.writeTimeout)); err != nil {
-				goto fail
+			signal(rpcConn.writable)
+			if isPending := request.IsPending() && request.setTimeout(); !isPending {
+				// a caller still waiting is told, the one gone has removed its response already
+				cp.endRequest(rpcConn, request, ErrRequestTimeout)
+			} else {
+				// write request
+				if err = rpcConn.SetWriteDeadline(time.Now().Add(request.writeTimeout)); err != nil {
+					goto fail
+				}
+				if err = rpcConn.WriteRequest(request.header, request.body); err != nil {
+					if isNetError(err) {
+						// println("write request: ", err.Error())
+						goto fail
+					}
+					// nothing is written, the connection is still usable
+					cp.failRequest(rpcConn, request, err)
+					err = nil
+				}
 			}
-			if err = rpcConn.WriteRequestHeader(request.header); err != nil {
-				// println("write request: ", err.Error())
-				goto fail
+			// the rest of the batch and the requests queued meanwhile are flushed together
+			if request.batched || len(rpcConn.pendingRequests) > 0 && !rpcConn.coalesceFull() {
+				continue
 			}
-			if request.header.IsPing() {
-				if err = rpcConn.FlushWriteToNet(); err != nil {
-					goto fail
+			if rpcConn.coalesceDelay > 0 && !rpcConn.coalesceFull() {
+				if delay == nil {
+					delay = time.After(rpcConn.coalesceDelay)
 				}
-				break
+				continue
 			}
-			if err = rpcConn.WriteRequestBody(request.body); err != nil {
+			delay = nil
+			if err = rpcConn.FlushWriteToNet(); err != nil {
 				goto fail
 			}
+		case <-delay:
+			delay = nil
 			if err = rpcConn.FlushWriteToNet(); err != nil {
 				goto fail
 			}
@@ -280,6 +463,31 @@ fail:
 	rpcConn.Unlock()
 }
 
+// fail the call whose request can not be encoded or exceeds the max frame size of the server
+func (cp *ConnPool) failRequest(rpcConn *ConnDriver, request *Request, err error) {
+	rpcErr := ErrGobParseErr.SetError(err)
+	if e, ok := err.(*CodecError); ok && IsRpcError(e.Err) {
+		rpcErr = e.Err.(*Error)
+	}
+	cp.endRequest(rpcConn, request, rpcErr)
+}
+
+// complete the pending response of the request unsent with rpcErr
+func (cp *ConnPool) endRequest(rpcConn *ConnDriver, request *Request, rpcErr *Error) {
+	rpcConn.Lock()
+	presp := rpcConn.RemovePendingResponse(request.header.Seq)
+	rpcConn.Unlock()
+	if presp == nil {
+		return
+	}
+	if presp.stream != nil {
+		presp.stream.end(rpcErr)
+		return
+	}
+	presp.err = rpcErr
+	presp.complete()
+}
+
 // GC the timer which is timeout
 // review_deadlock cp.lock() -> conn.timeLock.lock()
 func (cp *ConnPool) GCTimer() {
@@ -2,9 +2,9 @@ package gorpc
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
-	"encoding/gob"
-	// "fmt"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -24,23 +24,45 @@ var clientConnId ConnId
 // use by server
 var serverConnId ConnId
 
+// net.Conn of the server counting the bytes read and written,
+// it may be a tcp connection or a tls connection over tcp
 type Connection struct {
-	*net.TCPConn
+	net.Conn
 	server *Server
 }
 
-func NewConnection(conn *net.TCPConn, server *Server) *Connection {
+func NewConnection(conn net.Conn, server *Server) *Connection {
 	return &Connection{conn, server}
 }
 
 type ConnDriver struct {
-	*net.TCPConn
+	net.Conn
+	writer           io.Writer // under writeBuf
 	writeBuf         *bufio.Writer
-	dec              *gob.Decoder
-	enc              *gob.Encoder
+	readBuf          *bufio.Reader
+	codec            Codec
+	dec              Decoder
+	enc              Encoder
+	decBuf           bytes.Buffer             // header or body of the frame being decoded
+	encBuf           bytes.Buffer             // header and body of the frame being encoded
+	zipBuf           bytes.Buffer             // compressed body being written or read
+	compressor       Compressor               // negotiated in the handshake, nil means no compression
+	compressMin      int                      // bodies smaller than it are sent raw
+	readHead         frameHead                // head of the frame being read
+	encReset         bool                     // encoder is reset, flag the next frame
+	maxBodySize      int                      // max body size of the frames read
+	peerMaxBodySize  int                      // max body size accepted by the peer, told in the handshake
+	features         uint64                   // features negotiated in the handshake
+	principal        *Principal               // client authenticated in the handshake
+	streams          map[uint64]*ServerStream // streams running on the server, keyed by seq
+	coalesceBytes    int                      // bytes of the frames flushed together at most
+	coalesceDelay    time.Duration            // time a frame waits for more to flush together
+	writers          int32                    // goroutines waiting to write a frame
 	exitWriteNotify  chan bool
 	pendingRequests  chan *Request
-	sync.Mutex       // protects following
+	writable         chan struct{} // signaled when the write goroutine takes a request
+	done             chan struct{} // closed once the connection of the client is broken
+	sync.Mutex                     // protects following
 	pendingResponses map[uint64]*PendingResponse
 	connId           ConnId
 	netError         error
@@ -49,6 +71,8 @@ type ConnDriver struct {
 	callCount        int // for priority
 	workingElement   *list.Element
 	idleElement      *list.Element
+	goAway           bool // server asked to send no more requests
+	flushArmed       bool // a flush is scheduled after coalesceDelay
 
 	timeLock       sync.RWMutex // protects followinng
 	readDeadline   time.Time
@@ -58,39 +82,63 @@ type ConnDriver struct {
 
 // for flow control
 func (conn *Connection) Write(p []byte) (n int, err error) {
-	n, err = conn.TCPConn.Write(p)
+	n, err = conn.Conn.Write(p)
 	conn.server.status.IncrWriteBytes(uint64(n))
 	return
 }
 
 // for flow control
 func (conn *Connection) Read(p []byte) (n int, err error) {
-	n, err = conn.TCPConn.Read(p)
+	n, err = conn.Conn.Read(p)
 	conn.server.status.IncrReadBytes(uint64(n))
 	return
 }
 
-func NewConnDriver(conn *net.TCPConn, server *Server) *ConnDriver {
+func NewConnDriver(conn net.Conn, server *Server, codec Codec) *ConnDriver {
 	var c io.ReadWriter
+	maxBodySize := DefaultMaxResponseSize
 	if server != nil {
 		c = NewConnection(conn, server)
+		maxBodySize = DefaultMaxRequestSize
 	} else {
 		c = conn
 	}
-	buf := bufio.NewWriter(c)
-	return &ConnDriver{
-		TCPConn:          conn,
+	rpcConn := &ConnDriver{
+		Conn:             conn,
 		connId:           serverConnId.Incr(),
-		writeBuf:         buf,
-		dec:              gob.NewDecoder(c),
-		enc:              gob.NewEncoder(buf),
+		writer:           c,
+		writeBuf:         bufio.NewWriterSize(c, DefaultWriteCoalesceBytes),
+		coalesceBytes:    DefaultWriteCoalesceBytes,
+		readBuf:          bufio.NewReader(c),
+		codec:            codec,
+		maxBodySize:      maxBodySize,
 		exitWriteNotify:  make(chan bool, 1),
 		pendingResponses: make(map[uint64]*PendingResponse),
 		pendingRequests:  make(chan *Request, MaxPendingRequest),
+		writable:         make(chan struct{}, 1),
+		done:             make(chan struct{}),
 		// timer-gc to close timeout socket
 		readDeadline:  time.Now().Add(DefaultReadTimeout),
 		writeDeadline: time.Now().Add(DefaultWriteTimeout),
 	}
+	rpcConn.dec = codec.NewDecoder(&rpcConn.decBuf)
+	rpcConn.enc = codec.NewEncoder(&rpcConn.encBuf)
+	return rpcConn
+}
+
+// flush the frames up to maxBytes together, a frame waits up to maxDelay for more.
+// set before writing, the write buffer grows to maxBytes
+func (conn *ConnDriver) setWriteCoalesce(maxBytes int, maxDelay time.Duration) {
+	if maxBytes > conn.writeBuf.Size() {
+		conn.writeBuf = bufio.NewWriterSize(conn.writer, maxBytes)
+	}
+	conn.coalesceBytes = maxBytes
+	conn.coalesceDelay = maxDelay
+}
+
+// the frames buffered reach the max bytes to flush together
+func (conn *ConnDriver) coalesceFull() bool {
+	return conn.writeBuf.Buffered() >= conn.coalesceBytes
 }
 
 func (conn *ConnDriver) Sequence() uint64 {
@@ -137,27 +185,22 @@ func (conn *ConnDriver) isCloseByGCTimer() bool {
 }
 
 func (conn *ConnDriver) ReadRequestHeader(reqHeader *RequestHeader) error {
-	return conn.dec.Decode(reqHeader)
+	return conn.readHeader(reqHeader)
 }
 
+// return ErrRequestTooLarge without decoding if the body exceeds the max size
 func (conn *ConnDriver) ReadRequestBody(body interface{}) error {
-	return conn.dec.Decode(body)
-}
-
-func (conn *ConnDriver) WriteResponseHeader(respHeader *ResponseHeader) error {
-	return conn.enc.Encode(respHeader)
+	return conn.readBody(body, ErrRequestTooLarge)
 }
 
-func (conn *ConnDriver) WriteResponseBody(body interface{}) error {
-	return conn.enc.Encode(body)
+// write the request frame to the write buffer, the ping and the cancel requests have no body
+func (conn *ConnDriver) WriteRequest(reqHeader *RequestHeader, body interface{}) error {
+	return conn.writeFrame(reqHeader, body, reqHeader.hasBody(), reqHeader.Compress, ErrRequestTooLarge)
 }
 
-func (conn *ConnDriver) WriteRequestHeader(ReqHeader *RequestHeader) error {
-	return conn.enc.Encode(ReqHeader)
-}
-
-func (conn *ConnDriver) WriteRequestBody(body interface{}) error {
-	return conn.enc.Encode(body)
+// write the response frame to the write buffer, the body is written if the header have reply
+func (conn *ConnDriver) WriteResponse(respHeader *ResponseHeader, body interface{}) error {
+	return conn.writeFrame(respHeader, body, respHeader.HaveReply(), respHeader.compress, ErrResponseTooLarge)
 }
 
 func (conn *ConnDriver) FlushWriteToNet() error {
@@ -165,13 +208,175 @@ func (conn *ConnDriver) FlushWriteToNet() error {
 }
 
 func (conn *ConnDriver) ReadResponseHeader(RespHeader *ResponseHeader) error {
-	return conn.dec.Decode(RespHeader)
+	return conn.readHeader(RespHeader)
 }
 
+// return ErrResponseTooLarge without decoding if the body exceeds the max size
 func (conn *ConnDriver) ReadResponseBody(body interface{}) error {
+	return conn.readBody(body, ErrResponseTooLarge)
+}
+
+// read the head and the header of the next frame
+func (conn *ConnDriver) readHeader(header interface{}) error {
+	var head [FrameHeadSize]byte
+	if _, err := io.ReadFull(conn.readBuf, head[:]); err != nil {
+		return err
+	}
+	if err := conn.readHead.decode(head[:]); err != nil {
+		return err
+	}
+	if conn.readHead.flags&FrameFlagReset > 0 {
+		conn.dec = conn.codec.NewDecoder(&conn.decBuf)
+	}
+	if err := conn.readSegment(int64(conn.readHead.headerSize)); err != nil {
+		return err
+	}
+	return conn.dec.Decode(header)
+}
+
+// read the body of the frame whose header is just read,
+// the body exceeding the max size is discarded and errTooLarge returned
+func (conn *ConnDriver) readBody(body interface{}, errTooLarge *Error) error {
+	if conn.readHead.flags&FrameFlagBody == 0 {
+		if body == nil {
+			return nil
+		}
+		return errFrameNoBody
+	}
+	if err := conn.readBodySegment(errTooLarge); err != nil {
+		return err
+	}
 	return conn.dec.Decode(body)
 }
 
+// read the encoded body of a stream frame, decoded later by the decoder of the stream
+func (conn *ConnDriver) readStreamBody(errTooLarge *Error) ([]byte, error) {
+	if conn.readHead.flags&FrameFlagBody == 0 {
+		return nil, errFrameNoBody
+	}
+	if err := conn.readBodySegment(errTooLarge); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), conn.decBuf.Bytes()...), nil
+}
+
+// read the body into decBuf, decompressed if the frame is compressed
+func (conn *ConnDriver) readBodySegment(errTooLarge *Error) error {
+	size := int64(conn.readHead.bodySize)
+	if size > int64(conn.maxBodySize) {
+		if _, err := io.CopyN(io.Discard, conn.readBuf, size); err != nil {
+			return err
+		}
+		return errTooLarge.SetReason(fmt.Sprintf("%s: %d bytes exceeds %d", errTooLarge.Reason, size, conn.maxBodySize))
+	}
+	if conn.readHead.flags&FrameFlagCompressed == 0 {
+		return conn.readSegment(size)
+	}
+	if conn.compressor == nil {
+		return errFrameCompressor
+	}
+	conn.zipBuf.Reset()
+	if _, err := io.CopyN(&conn.zipBuf, conn.readBuf, size); err != nil {
+		return err
+	}
+	conn.decBuf.Reset()
+	if err := conn.compressor.Decompress(&conn.decBuf, conn.zipBuf.Bytes(), conn.maxBodySize); err != nil {
+		if err == errDecompressTooLarge {
+			return errTooLarge.SetReason(fmt.Sprintf("%s: decompressed body exceeds %d", errTooLarge.Reason, conn.maxBodySize))
+		}
+		return &CodecError{err}
+	}
+	return nil
+}
+
+func (conn *ConnDriver) readSegment(size int64) error {
+	conn.decBuf.Reset()
+	_, err := io.CopyN(&conn.decBuf, conn.readBuf, size)
+	return err
+}
+
+// encode header and body then write the frame to the write buffer. nothing is written
+// if the encoding fails or the body exceeds the max size of the peer, the error is a
+// *CodecError, wrapping errTooLarge for the body too large
+func (conn *ConnDriver) writeFrame(header interface{}, body interface{}, hasBody bool, compress int8, errTooLarge *Error) error {
+	conn.encBuf.Reset()
+	if err := conn.enc.Encode(header); err != nil {
+		conn.resetEncoder()
+		return asCodecError(err)
+	}
+	headerSize := conn.encBuf.Len()
+	if raw, ok := body.(rawBody); ok && hasBody {
+		// encoded by the encoder of a stream
+		conn.encBuf.Write(raw)
+	} else if hasBody {
+		if err := conn.enc.Encode(body); err != nil {
+			conn.resetEncoder()
+			return asCodecError(err)
+		}
+	}
+	// the peer would discard it without decoding
+	if size := conn.encBuf.Len() - headerSize; conn.peerMaxBodySize > 0 && size > conn.peerMaxBodySize {
+		conn.resetEncoder()
+		return &CodecError{errTooLarge.SetReason(fmt.Sprintf("%s: %d bytes exceeds %d", errTooLarge.Reason, size, conn.peerMaxBodySize))}
+	}
+	head := frameHead{
+		version:    FrameVersion,
+		headerSize: uint32(headerSize),
+	}
+	if hasBody {
+		head.flags |= FrameFlagBody
+	}
+	if hasBody && conn.compressBody(headerSize, compress) {
+		head.flags |= FrameFlagCompressed
+	}
+	head.bodySize = uint32(conn.encBuf.Len() - headerSize)
+	if conn.encReset {
+		head.flags |= FrameFlagReset
+		conn.encReset = false
+	}
+	var b [FrameHeadSize]byte
+	head.encode(b[:])
+	if _, err := conn.writeBuf.Write(b[:]); err != nil {
+		return err
+	}
+	_, err := conn.writeBuf.Write(conn.encBuf.Bytes())
+	return err
+}
+
+// replace the encoded body following the header with the compressed one,
+// return false if the body is sent raw
+func (conn *ConnDriver) compressBody(headerSize int, compress int8) bool {
+	size := conn.encBuf.Len() - headerSize
+	if conn.compressor == nil || compress == CompressNever || size == 0 {
+		return false
+	}
+	if compress != CompressAlways && size < conn.compressMin {
+		return false
+	}
+	conn.zipBuf.Reset()
+	if err := conn.compressor.Compress(&conn.zipBuf, conn.encBuf.Bytes()[headerSize:]); err != nil || conn.zipBuf.Len() >= size {
+		return false
+	}
+	conn.encBuf.Truncate(headerSize)
+	conn.encBuf.Write(conn.zipBuf.Bytes())
+	return true
+}
+
+// the discarded frame may carry the state of a stateful encoder, such as the type
+// definitions of gob. start a new encoder and tell the peer to start a new decoder
+func (conn *ConnDriver) resetEncoder() {
+	if conn.isStateful() {
+		conn.enc = conn.codec.NewEncoder(&conn.encBuf)
+		conn.encReset = true
+	}
+}
+
+// the stream of a stateful codec is broken once a body is skipped without decoding
+func (conn *ConnDriver) isStateful() bool {
+	codec, ok := conn.codec.(StatefulCodec)
+	return ok && codec.Stateful()
+}
+
 func (conn *ConnDriver) PendingResponseCount() int {
 	return len(conn.pendingResponses)
 }
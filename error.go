@@ -18,10 +18,13 @@ var (
 	ErrNoWorkingConn      = &Error{102, ErrTypeLogic, "client no working connection"}
 	ErrCallConnectTimeout = &Error{103, ErrTypeLogic, "client no connect timeout"}
 	ErrIdleClose          = &Error{104, ErrTypeLogic, "client idle pool full close"}
+	ErrRequestCanceled    = &Error{105, ErrTypeLogic, "client request canceled"}
 	ErrUnknow             = &Error{107, ErrTypeLogic, ""}
 	// critical error unexpected error
-	ErrGobParseErr    = &Error{106, ErrTypeCritical, ""}
-	ErrInvalidAddress = &Error{108, ErrTypeCritical, "client invalid address"}
+	ErrGobParseErr      = &Error{106, ErrTypeCritical, ""}
+	ErrInvalidAddress   = &Error{108, ErrTypeCritical, "client invalid address"}
+	ErrResponseTooLarge = &Error{114, ErrTypeCritical, "client response body too large"}
+	ErrStreamClosed     = &Error{115, ErrTypeLogic, "client stream closed"}
 
 	ErrNetConnectFail         = &Error{109, ErrTypeNet, ""}
 	ErrNetReadFail            = &Error{110, ErrTypeNet, ""}
@@ -35,7 +38,19 @@ var (
 
 // server error,error code >= 400
 var (
-	ErrNotFound = &Error{400, ErrTypeCritical, "server invalid service or method"}
+	ErrNotFound         = &Error{400, ErrTypeCritical, "server invalid service or method"}
+	ErrUnauthenticated  = &Error{401, ErrTypeCritical, "server unauthenticated"}
+	ErrForbidden        = &Error{403, ErrTypeCritical, "server call forbidden"}
+	ErrRequestExpired   = &Error{408, ErrTypeLogic, "server request expired before execution"}
+	ErrFlowControl      = &Error{409, ErrTypeCritical, "server stream window exceeded"}
+	ErrRequestTooLarge  = &Error{413, ErrTypeCritical, "server request body too large"}
+	ErrHandshakeCodec   = &Error{415, ErrTypeCritical, "server unsupported codec"}
+	ErrHandshakeVersion = &Error{426, ErrTypeCritical, "server unsupported protocol version"}
+	ErrRateLimited      = &Error{429, ErrTypeCanRetry, "server rate limit exceeded"}
+	ErrServerShutdown   = &Error{503, ErrTypeCanRetry, "server is shutting down"}
+	ErrServicePanic     = &Error{510, ErrTypeCritical, "server service panic"}
+	ErrReplyEncodeFail  = &Error{511, ErrTypeCritical, "server encode reply fail"}
+	ErrServerOverload   = &Error{512, ErrTypeCanRetry, "server overloaded"}
 )
 
 // user defined error, error code > 10000
@@ -96,6 +111,9 @@ func IsRpcError(err interface{}) bool {
 }
 
 func isNetError(err error) bool {
+	if _, ok := err.(*CodecError); ok {
+		return false
+	}
 	e := err.Error()
 	if len(e) >= 4 && e[0:4] == "gob:" {
 		return false
@@ -0,0 +1,85 @@
+package gorpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// every request and response is sent as a frame:
+//
+//	magic        2 bytes  0x4752 "GR"
+//	version      1 byte
+//	flags        1 byte
+//	header size  4 bytes  big-endian
+//	body size    4 bytes  big-endian, the body may be empty
+//
+// followed by the header and the body encoded by the codec of the connection
+const (
+	FrameMagic    = 0x4752
+	FrameVersion  = 1
+	FrameHeadSize = 12
+	// headers are small, a larger one means the stream is corrupted
+	MaxFrameHeaderSize = 64 * 1024
+)
+
+// frame flags
+const (
+	// the sender has reset its encoder after an encoding failure,
+	// the receiver resets its decoder before decoding this frame
+	FrameFlagReset = 0x01
+	// the body is compressed by the compressor negotiated in the handshake
+	FrameFlagCompressed = 0x02
+	// the frame carries a body, which is empty for some values such as the proto defaults
+	FrameFlagBody = 0x04
+)
+
+var (
+	errFrameMagic      = errors.New("gorpc: invalid frame magic")
+	errFrameVersion    = errors.New("gorpc: unsupported frame version")
+	errFrameHeaderSize = errors.New("gorpc: frame header too large")
+	errFrameNoBody     = &CodecError{errors.New("gorpc: frame has no body")}
+	errFrameCompressor = &CodecError{errors.New("gorpc: compressed frame without compressor")}
+)
+
+type frameHead struct {
+	version    uint8
+	flags      uint8
+	headerSize uint32
+	bodySize   uint32
+}
+
+func (head *frameHead) encode(b []byte) {
+	binary.BigEndian.PutUint16(b[0:2], FrameMagic)
+	b[2] = head.version
+	b[3] = head.flags
+	binary.BigEndian.PutUint32(b[4:8], head.headerSize)
+	binary.BigEndian.PutUint32(b[8:12], head.bodySize)
+}
+
+func (head *frameHead) decode(b []byte) error {
+	if binary.BigEndian.Uint16(b[0:2]) != FrameMagic {
+		return errFrameMagic
+	}
+	head.version = b[2]
+	head.flags = b[3]
+	head.headerSize = binary.BigEndian.Uint32(b[4:8])
+	head.bodySize = binary.BigEndian.Uint32(b[8:12])
+	if head.version != FrameVersion {
+		return errFrameVersion
+	}
+	if head.headerSize > MaxFrameHeaderSize {
+		return errFrameHeaderSize
+	}
+	return nil
+}
+
+// the codecs decode from a reader holding exactly one header or body,
+// readSegment returns all of it without copying when possible
+func readSegment(r io.Reader) ([]byte, error) {
+	if buf, ok := r.(*bytes.Buffer); ok {
+		return buf.Next(buf.Len()), nil
+	}
+	return io.ReadAll(r)
+}
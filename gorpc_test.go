@@ -2,18 +2,33 @@
 package gorpc
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/johntech-o/gorpc/utility/pprof"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	cal"github.com/johntech-o/gorpc/utility/calculator"
 )
 
@@ -69,6 +84,108 @@ func (r *TestRpcInt) EchoStruct(arg TestABC, res *string) error {
 	return nil
 }
 
+func (r *TestRpcInt) Sleep(ms int, res *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*res = ms
+	return nil
+}
+
+// report the deadline the caller propagated through the context
+func (r *TestRpcInt) Deadline(ctx context.Context, n int, res *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline in context")
+	}
+	*res = int64(time.Until(deadline))
+	return nil
+}
+
+func (r *TestRpcInt) Panic(n int, res *int) error {
+	var m map[int]int
+	m[n] = n
+	return nil
+}
+
+type TestFuncReply struct {
+	F interface{}
+}
+
+// reply a value can not be encoded
+func (r *TestRpcInt) FuncReply(n int, res *TestFuncReply) error {
+	res.F = func() {}
+	return nil
+}
+
+// reply a large and compressible string
+func (r *TestRpcInt) Repeat(n int, res *string) error {
+	*res = strings.Repeat("gorpc ", n)
+	return nil
+}
+
+var streamCanceled = make(chan struct{}, 1)
+
+// send 0 to n-1, or wait for the cancellation if n is 0
+func (r *TestRpcInt) Count(n int, stream *ServerStream) error {
+	if n < 0 {
+		return errors.New("negative count")
+	}
+	if n == 0 {
+		<-stream.Context().Done()
+		streamCanceled <- struct{}{}
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive ints until the client closes the sending, reply the sum
+func (r *TestRpcInt) Sum(stream *ServerStream) error {
+	sum := 0
+	for {
+		var n int
+		if err := stream.Recv(&n); err == io.EOF {
+			return stream.Send(sum)
+		} else if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+// send back the values received
+func (r *TestRpcInt) Echo(stream *ServerStream) error {
+	for {
+		var s string
+		if err := stream.Recv(&s); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send(s); err != nil {
+			return err
+		}
+	}
+}
+
+// receive nothing until the stream is canceled
+func (r *TestRpcInt) Hold(stream *ServerStream) error {
+	<-stream.Context().Done()
+	return nil
+}
+
+var idleCanceled = make(chan struct{}, 1)
+
+// receive nothing until the cancellation
+func (r *TestRpcInt) Idle(stream *ServerStream) error {
+	<-stream.Context().Done()
+	idleCanceled <- struct{}{}
+	return nil
+}
+
 var StopClient2 = make(chan struct{})
 var MaxQps uint64
 
@@ -244,3 +361,1420 @@ func TestEchoStruct(t *testing.T) {
 	fmt.Printf("Max Client Qps: %d \n", MaxQps)
 	time.Sleep(time.Microsecond)
 }
+
+func TestServerShutdown(t *testing.T) {
+	sleeping := make(chan struct{}, 1)
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			if call.Method == "Sleep" {
+				sleeping <- struct{}{}
+			}
+			return invoke(call)
+		})
+	}, nil)
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil {
+		t.Fatal("call before shutdown fail", e)
+	}
+	done := make(chan *Error, 1)
+	go func() {
+		var ms int
+		done <- c.CallWithAddress("pipe", "TestRpcInt", "Sleep", 300, &ms)
+	}()
+	<-sleeping
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error("shutdown fail", err)
+	}
+	if e := <-done; e != nil {
+		t.Error("in-flight call fail", e)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e == nil {
+		t.Error("call after shutdown should fail")
+	}
+}
+
+// the replies waiting for the delayed flush are written before the connections are closed
+func TestServerShutdownCoalesce(t *testing.T) {
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetWriteCoalesce(DefaultWriteCoalesceBytes, time.Millisecond*20)
+	}, nil)
+	var ms int
+	call := c.GoWithAddress("pipe", "TestRpcInt", "Sleep", 50, &ms, nil)
+	waitFor(t, "call in flight", func() bool { return atomic.LoadInt64(&s.inflight) > 0 })
+	// the reply is buffered for the delayed flush
+	waitFor(t, "call replied", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error("shutdown fail", err)
+	}
+	if call = <-call.Done; call.Error != nil {
+		t.Error("in-flight call fail", call.Error)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	s, c, _ := newPipeServerClient(t, nil, nil)
+	var ms int
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	e := c.CallWithAddressContext(ctx, "pipe", "TestRpcInt", "Sleep", 100, &ms)
+	if e == nil || e.Errno() != ErrRequestCanceled.Errno() {
+		t.Error("fail", e)
+	}
+	e = c.CallWithAddressContext(ctx, "pipe", "TestRpcInt", "Update", 1, &ms)
+	if e == nil || e.Errno() != ErrRequestCanceled.Errno() {
+		t.Error("call with done context should fail", e)
+	}
+
+	// the late reply of the canceled call is dropped, not decoded into the reply
+	waitFor(t, "canceled call replied", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	ms = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan *Error, 1)
+	go func() {
+		done <- c.CallWithAddressContext(ctx, "pipe", "TestRpcInt", "Sleep", 50, &ms)
+	}()
+	waitFor(t, "in-flight call", func() bool { return atomic.LoadInt64(&s.inflight) > 0 })
+	cancel()
+	if e = <-done; e == nil || e.Errno() != ErrRequestCanceled.Errno() {
+		t.Error("canceled call should fail", e)
+	}
+	ms = -1
+	// the only connection reads the late reply before the reply of the next call
+	waitFor(t, "late reply sent", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	var res string
+	if e = c.CallWithAddress("pipe", "TestRpcInt", "Repeat", 1, &res); e != nil {
+		t.Fatal("call after cancel fail", e)
+	}
+	if ms != -1 {
+		t.Error("late reply is decoded into the reply of the canceled call", ms)
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	_, c, _ := newPipeServerClient(t, nil, nil)
+	var remaining int64
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	e := c.CallWithAddressContext(ctx, "pipe", "TestRpcInt", "Deadline", 1, &remaining)
+	if e != nil {
+		t.Fatal("fail", e)
+	}
+	if remaining <= 0 || time.Duration(remaining) > time.Second {
+		t.Error("unexpected remaining time of deadline", time.Duration(remaining))
+	}
+}
+
+// gob under another id, counting the values encoded
+type countingCodec struct {
+	Codec
+	encoded *int32
+}
+
+type countingEncoder struct {
+	Encoder
+	encoded *int32
+}
+
+func (e countingEncoder) Encode(v interface{}) error {
+	atomic.AddInt32(e.encoded, 1)
+	return e.Encoder.Encode(v)
+}
+
+func (c countingCodec) Id() int {
+	return 100
+}
+
+func (c countingCodec) Name() string {
+	return "counting gob"
+}
+
+func (c countingCodec) NewEncoder(w io.Writer) Encoder {
+	return countingEncoder{c.Codec.NewEncoder(w), c.encoded}
+}
+
+func (c countingCodec) Stateful() bool {
+	return true
+}
+
+func TestCodec(t *testing.T) {
+	if codec := CodecById(GobCodec); codec == nil || codec.Name() != "gob" {
+		t.Fatal("gob codec should be registered", codec)
+	}
+	if CodecById(255) != nil {
+		t.Fatal("unregistered codec should not be found")
+	}
+	codec := countingCodec{NewGobCodec(), new(int32)}
+	RegisterCodec(codec)
+	if CodecById(codec.Id()) == nil {
+		t.Fatal("registered codec should be found")
+	}
+	s, c, listener := newPipeServerClient(t, func(s *Server) {
+		if s.codec.Id() != GobCodec {
+			t.Error("server should use gob by default", s.codec.Name())
+		}
+		if err := s.SetCodec(codec); err != nil {
+			t.Fatal(err)
+		}
+	}, NewServerOptions("pipe", 1, 1).SetCodec(codec))
+	var res string
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Repeat", 2, &res); e != nil || res != "gorpc gorpc " {
+		t.Error("fail", e, res)
+	}
+	if atomic.LoadInt32(codec.encoded) == 0 {
+		t.Error("the values should be encoded by the codec set")
+	}
+	// the client using gob by default is rejected by the server
+	gob := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	gob.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(listener.Dial)})
+	if e := gob.CallWithAddress("pipe", "TestRpcInt", "Repeat", 1, &res); e == nil {
+		t.Error("call with a codec the server does not use should fail")
+	}
+	if s.codec.Id() != codec.Id() {
+		t.Error("server should use the codec set", s.codec.Name())
+	}
+}
+
+func TestJsonCodec(t *testing.T) {
+	_, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetCodec(NewJsonCodec())
+	}, NewServerOptions("pipe", 2, 1).SetCodec(NewJsonCodec()))
+	var res string
+	if e := c.Call("TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &res); e != nil || res != EchoContent {
+		t.Error("fail", e, res)
+	}
+	var up int
+	if e := c.Call("TestRpcInt", "Update", "5", &up); e == nil || e.Errno() != 400 {
+		t.Error("invalid args should fail with 400", e)
+	}
+	if e := c.Call("TestRpcInt", "Update", 5, &up); e != nil || up != 105 {
+		t.Error("fail", e, up)
+	}
+}
+
+type TestRpcProto struct{}
+
+func (r *TestRpcProto) Echo(arg *wrapperspb.StringValue, res *wrapperspb.StringValue) error {
+	res.Value = arg.Value
+	return nil
+}
+
+// send the argument three times
+func (r *TestRpcProto) Repeat(arg *wrapperspb.StringValue, stream *ServerStream) error {
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send back the values received
+func (r *TestRpcProto) EchoStream(stream *ServerStream) error {
+	for {
+		v := &wrapperspb.Int64Value{}
+		if err := stream.Recv(v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send(v); err != nil {
+			return err
+		}
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		if err := s.SetCodec(NewProtoCodec()); err != nil {
+			t.Fatal(err)
+		}
+		s.Register(new(TestRpcProto))
+	}, NewServerOptions("pipe", 2, 1).SetCodec(NewProtoCodec()))
+	if _, ok := s.serviceMap["TestRpcInt"].method["EchoStruct"]; ok {
+		t.Error("method with non-proto args should not be registered")
+	}
+	res := &wrapperspb.StringValue{}
+	if e := c.Call("TestRpcProto", "Echo", wrapperspb.String(EchoContent), res); e != nil || res.Value != EchoContent {
+		t.Error("fail", e, res)
+	}
+	var up int
+	if e := c.Call("TestRpcInt", "Update", 5, &up); e != nil || up != 105 {
+		t.Error("fail", e, up)
+	}
+	if e := c.Call("TestRpcInt", "EchoStruct", 5, &up); e == nil || e.Errno() != 400 {
+		t.Error("unregistered method should fail with 400", e)
+	}
+
+	// the default values are encoded to empty bodies
+	res.Value = EchoContent
+	if e := c.Call("TestRpcProto", "Echo", wrapperspb.String(""), res); e != nil || res.Value != "" {
+		t.Error("empty message fail", e, res)
+	}
+	stream, e := c.StreamWithAddress(context.Background(), "pipe", "TestRpcProto", "Repeat", wrapperspb.String(""))
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	for i := 0; ; i++ {
+		res.Value = EchoContent
+		if err := stream.Recv(res); err != nil {
+			if err != io.EOF || i != 3 {
+				t.Error("stream end", err, i)
+			}
+			break
+		}
+		if res.Value != "" {
+			t.Error("stream reply", res)
+		}
+	}
+	stream, e = c.OpenStreamWithAddress(context.Background(), "pipe", "TestRpcProto", "EchoStream")
+	if e != nil {
+		t.Fatal("open stream fail", e)
+	}
+	for i := int64(0); i < 2; i++ {
+		if err := stream.Send(wrapperspb.Int64(i)); err != nil {
+			t.Fatal("send fail", err)
+		}
+		n := wrapperspb.Int64(-1)
+		if err := stream.Recv(n); err != nil || n.Value != i {
+			t.Error("stream echo", err, n, i)
+		}
+	}
+	stream.Close()
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetMaxRequestSize(1024)
+	}, NewServerOptions("pipe", 1, 1).SetMaxResponseSize(1024))
+	large := string(make([]byte, 2048))
+	var res string
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &res); e != nil || res != EchoContent {
+		t.Error("fail", e, res)
+	}
+	// the body larger than the peer accepts fails without being sent
+	readBytes := atomic.LoadUint64(&s.status.ReadBytes)
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{large, "bbb", "ccc"}, &res); e == nil || e.Errno() != ErrRequestTooLarge.Errno() {
+		t.Error("large request should fail with 413", e)
+	}
+	if n := atomic.LoadUint64(&s.status.ReadBytes) - readBytes; n > 1024 {
+		t.Error("large request sent", n)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Repeat", 500, &res); e == nil || e.Errno() != ErrResponseTooLarge.Errno() {
+		t.Error("large response should fail with 114", e)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &res); e != nil || res != EchoContent {
+		t.Error("fail", e, res)
+	}
+}
+
+func TestServerInterceptor(t *testing.T) {
+	var replies = make(chan interface{}, 1)
+	_, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			if n, ok := call.Arg.(int); ok && n < 0 {
+				return NewError(10001, ErrTypeLogic, "negative argument")
+			}
+			e := invoke(call)
+			replies <- *call.Reply.(*int)
+			return e
+		})
+	}, nil)
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", -1, &res); e == nil || e.Errno() != 10001 {
+		t.Error("interceptor should short-circuit the call", e)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("fail", e, res)
+	}
+	if reply := <-replies; reply != 101 {
+		t.Error("interceptor see wrong reply", reply)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	var calls int32
+	_, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			if call.Meta["trace-id"] != "abc" {
+				return NewError(10001, ErrTypeLogic, "no trace id")
+			}
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return NewError(10002, ErrTypeCanRetry, "retry please")
+			}
+			return invoke(call)
+		})
+	}, NewServerOptions("pipe", 2, 1))
+	var address string
+	var retries int
+	c.Use(func(call *ClientCall, invoke ClientInvoker) *Error {
+		call.Meta = map[string]string{"trace-id": "abc"}
+		e := invoke(call)
+		address, retries = call.Address, call.Retries
+		return e
+	})
+	var res int
+	if e := c.Call("TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("fail", e, res)
+	}
+	if address != "pipe" || retries != 1 {
+		t.Error("interceptor see wrong address or retries", address, retries)
+	}
+}
+
+func TestServicePanic(t *testing.T) {
+	stacks := make(chan []byte, 1)
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetPanicHandler(func(call *ServerCall, v interface{}, stack []byte) {
+			stacks <- stack
+		})
+	}, nil)
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Panic", 1, &res); e == nil || e.Errno() != ErrServicePanic.Errno() {
+		t.Error("panic should be replied with 510", e)
+	}
+	if stack := <-stacks; !strings.Contains(string(stack), "Panic") {
+		t.Error("stack does not contain the service method", string(stack))
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("fail", e, res)
+	}
+	if n := atomic.LoadUint64(&s.status.PanicAmount); n != 1 {
+		t.Error("panic amount", n)
+	}
+}
+
+func TestReplyEncodeFail(t *testing.T) {
+	for _, codec := range []Codec{NewGobCodec(), NewJsonCodec()} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			s, c, _ := newPipeServerClient(t, func(s *Server) {
+				s.SetCodec(codec)
+			}, NewServerOptions("pipe", 2, 1).SetCodec(codec))
+			var reply TestFuncReply
+			if e := c.Call("TestRpcInt", "FuncReply", 1, &reply); e == nil || e.Errno() != ErrReplyEncodeFail.Errno() {
+				t.Error("unencodable reply should fail with 511", e)
+			}
+			var res int
+			if e := c.Call("TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+				t.Error("fail", e, res)
+			}
+			if n := atomic.LoadUint64(&s.status.EncodeErrorAmount); n != 1 {
+				t.Error("encode error amount", n)
+			}
+		})
+	}
+}
+
+// issue a certificate signed by ca, a self-signed ca if ca is nil
+func testCert(t *testing.T, serial int64, ca *tls.Certificate) (*tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return &cert, certPem, keyPem
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, _, _ := testCert(t, 1, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert := func(serial int64) {
+		_, certPem, keyPem := testCert(t, serial, ca)
+		if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCert(2)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	s := NewServerWithListener(listener)
+	// replaced by the config set later
+	s.SetTLSConfig(&tls.Config{})
+	s.SetTLSConfig(&tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      pool,
+	})
+	s.Register(new(TestRpcInt))
+	go s.Serve()
+	defer s.Close()
+
+	clientCert, _, _ := testCert(t, 3, ca)
+	var serial int64
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c.AddServers([]*ServerOptions{NewServerOptions(address, 1, 1).SetTLSConfig(&tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{*clientCert},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			atomic.StoreInt64(&serial, state.PeerCertificates[0].SerialNumber.Int64())
+			return nil
+		},
+	})})
+	var res int
+	if e := c.Call("TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("tls call fail", e, res)
+	}
+	if n := atomic.LoadInt64(&serial); n != 2 {
+		t.Error("server certificate serial", n)
+	}
+
+	noCert := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	noCert.AddServers([]*ServerOptions{NewServerOptions(address, 1, 1).SetTLSConfig(&tls.Config{RootCAs: pool})})
+	if e := noCert.Call("TestRpcInt", "Update", 1, &res); e == nil {
+		t.Error("client without certificate should fail")
+	}
+
+	// a renewed certificate is used by the new connections
+	writeCert(4)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c2 := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c2.AddServers([]*ServerOptions{NewServerOptions(address, 1, 1).SetTLSConfig(&tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{*clientCert},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			atomic.StoreInt64(&serial, state.PeerCertificates[0].SerialNumber.Int64())
+			return nil
+		},
+	})})
+	if e := c2.Call("TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("tls call after reload fail", e, res)
+	}
+	if n := atomic.LoadInt64(&serial); n != 4 {
+		t.Error("reloaded server certificate serial", n)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gorpc.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithListener(listener)
+	s.Register(new(TestRpcInt))
+	go s.Serve()
+	defer s.Close()
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	address := UnixAddressPrefix + path
+	c.AddServers([]*ServerOptions{NewServerOptions(address, 2, 1)})
+	var res int
+	if e := c.CallWithAddress(address, "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("unix socket call fail", e, res)
+	}
+}
+
+// serve TestRpcInt on an in-memory listener configured by setup before Serve, the
+// client connects it as "pipe" by options, NewServerOptions("pipe", 1, 1) if nil.
+// the server is closed when the test ends
+func newPipeServerClient(t *testing.T, setup func(s *Server), options *ServerOptions) (*Server, *Client, *PipeListener) {
+	t.Helper()
+	listener := NewPipeListener()
+	s := NewServerWithListener(listener)
+	if setup != nil {
+		setup(s)
+	}
+	s.Register(new(TestRpcInt))
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	if options == nil {
+		options = NewServerOptions("pipe", 1, 1)
+	}
+	if options.dialer == nil {
+		options.SetDialer(listener.Dial)
+	}
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c.AddServers([]*ServerOptions{options})
+	return s, c, listener
+}
+
+// poll cond until it holds, fail the test after 2 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	_, c, _ := newPipeServerClient(t, nil, NewServerOptions("pipe", 4, 2))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var res string
+				if e := c.CallWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &res); e != nil || res != EchoContent {
+					t.Error("pipe call fail", e, res)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHandshake(t *testing.T) {
+	_, c, listener := newPipeServerClient(t, func(s *Server) {
+		s.SetCodec(NewJsonCodec())
+	}, nil)
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e == nil || e.Errno() != ErrHandshakeCodec.Errno() {
+		t.Error("codec mismatch should fail with 415", e)
+	}
+
+	conn, err := listener.Dial("pipe", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := clientHandshake(conn, &Handshake{Version: 0, Codec: JsonCodec}, time.Second); err == nil || err.(*Error).Errno() != ErrHandshakeVersion.Errno() {
+		t.Error("old version should fail with 426", err)
+	}
+
+	conn, err = listener.Dial("pipe", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := clientHandshake(conn, &Handshake{Version: HandshakeVersion + 1, Codec: JsonCodec, Features: 1<<40 | FeatureGoAway}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Version != HandshakeVersion || reply.Features != FeatureGoAway || reply.MaxFrameSize != DefaultMaxRequestSize {
+		t.Error("negotiated", reply)
+	}
+
+	// the client rejects the reply not matching its handshake
+	for _, c := range []struct {
+		reply *Handshake
+		errno int
+	}{
+		{&Handshake{Version: 0, Codec: GobCodec}, ErrHandshakeVersion.Errno()},
+		{&Handshake{Version: HandshakeVersion, Codec: JsonCodec}, ErrHandshakeCodec.Errno()},
+	} {
+		client, server := net.Pipe()
+		go func(reply *Handshake) {
+			var hs Handshake
+			readHandshake(server, &hs)
+			writeHandshake(server, reply)
+		}(c.reply)
+		if _, err := clientHandshake(client, &Handshake{Version: HandshakeVersion, Codec: GobCodec}, time.Second); err == nil || err.(*Error).Errno() != c.errno {
+			t.Error("reply should be rejected", c.reply, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// counts the bytes read from the connection
+type readCountingConn struct {
+	net.Conn
+	reads *uint64
+}
+
+func (c readCountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.reads, uint64(n))
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	for _, name := range []string{"snappy", "gzip"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			var listener *PipeListener
+			var reads uint64
+			dialer := func(address string, timeout time.Duration) (net.Conn, error) {
+				conn, err := listener.Dial(address, timeout)
+				return readCountingConn{conn, &reads}, err
+			}
+			_, c, listener := newPipeServerClient(t, nil, NewServerOptions("pipe", 1, 1).SetDialer(dialer).SetCompressions(1024, "unknown", name))
+			// bytes read by the client for a reply
+			replyBytes := func(service, method string, n int) uint64 {
+				before := atomic.LoadUint64(&reads)
+				var res string
+				if e := c.CallWithAddress("pipe", service, method, n, &res); e != nil || res != strings.Repeat("gorpc ", n) {
+					t.Fatal("call fail", e, len(res))
+				}
+				return atomic.LoadUint64(&reads) - before
+			}
+			if n := replyBytes("TestRpcInt", "Repeat", 10000); n >= 10000 {
+				t.Error("reply not compressed", n)
+			}
+			if n := replyBytes("TestRpcInt", "Repeat", 100); n < 600 {
+				t.Error("reply below threshold compressed", n)
+			}
+			c.SetMethodNetOptinons("TestRpcInt", "Repeat", NewNetOptions(time.Second, time.Second*2, time.Second*2).SetCompress(CompressNever))
+			if n := replyBytes("TestRpcInt", "Repeat", 10000); n < 60000 {
+				t.Error("reply of method without compression compressed", n)
+			}
+		})
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	var principal string
+	s, _, listener := newPipeServerClient(t, func(s *Server) {
+		s.SetAuthenticator(NewTokenAuthenticator(map[string]string{"secret": "alice"}))
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			principal = call.Principal.Name
+			return invoke(call)
+		})
+	}, nil)
+	var res int
+	for token, errno := range map[string]int{"": 401, "wrong": 401, "secret": 0} {
+		c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+		c.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(listener.Dial).SetToken(token)})
+		e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res)
+		if errno == 0 && (e != nil || principal != "alice") {
+			t.Error("token", token, "call fail", e, principal)
+		}
+		if errno != 0 && (e == nil || e.Errno() != errno) {
+			t.Error("token", token, "should fail with", errno, e)
+		}
+	}
+
+	key := []byte("hmac key")
+	hmacAuth := NewHMACAuthenticator(key)
+	if p, err := hmacAuth.Authenticate(NewHMACToken(key, "bob.svc", time.Now().Add(time.Hour)), nil); err != nil || p.Name != "bob.svc" {
+		t.Error("hmac token", p, err)
+	}
+	if _, err := hmacAuth.Authenticate(NewHMACToken(key, "bob", time.Now().Add(-time.Second)), nil); err == nil {
+		t.Error("expired hmac token should fail")
+	}
+	if _, err := hmacAuth.Authenticate(NewHMACToken([]byte("other key"), "bob", time.Now().Add(time.Hour)), nil); err == nil {
+		t.Error("hmac token of other key should fail")
+	}
+
+	// the calls fail once the principal of the connection expires
+	s.SetAuthenticator(AuthenticatorFunc(func(token string, remoteAddr net.Addr) (*Principal, error) {
+		return &Principal{Name: token, Expires: time.Now().Add(time.Millisecond * 100)}, nil
+	}))
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(listener.Dial).SetToken("carol")})
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil || principal != "carol" {
+		t.Error("call before expiry fail", e, principal)
+	}
+	waitFor(t, "call after expiry failing with 401", func() bool {
+		e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res)
+		return e != nil && e.Errno() == ErrUnauthenticated.Errno()
+	})
+}
+
+func TestAccessPolicy(t *testing.T) {
+	// the rules match the network of the client, it connects over tcp
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	s := NewServerWithListener(listener)
+	s.Register(new(TestRpcInt))
+	policy := NewAccessPolicy(true)
+	if err := policy.SetRule("RpcStatus", "", AccessRule{Networks: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.SetRule("TestRpcInt", "Update", AccessRule{Identities: []string{"admin"}, Networks: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuthorizer(policy)
+	go s.Serve()
+	defer s.Close()
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	var res int
+	var status string
+	if e := c.CallWithAddress(address, "RpcStatus", "CallStatus", false, &status); e == nil || e.Errno() != ErrForbidden.Errno() {
+		t.Error("status from other network should fail with 403", e)
+	}
+	if e := c.CallWithAddress(address, "TestRpcInt", "Update", 1, &res); e == nil || e.Errno() != ErrForbidden.Errno() {
+		t.Error("update without identity should fail with 403", e)
+	}
+	if e := c.CallWithAddress(address, "TestRpcInt", "Sleep", 1, &res); e != nil {
+		t.Error("method without rule fail", e)
+	}
+	c.SetCaller("admin")
+	if e := c.CallWithAddress(address, "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("update of admin fail", e, res)
+	}
+	if n := atomic.LoadUint64(&s.status.DeniedAmount); n != 2 {
+		t.Error("denied amount", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetRateLimit("TestRpcInt", "Update", 1, 2)
+	}, nil)
+	var res int
+	for i := 0; i < 2; i++ {
+		if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil {
+			t.Error("call within burst fail", e)
+		}
+	}
+	// retried once and limited again
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e == nil || e.Errno() != ErrRateLimited.Errno() || !CanRetry(e) {
+		t.Error("call over limit should fail with 429", e)
+	}
+	if n := atomic.LoadUint64(&s.status.RateLimitedAmount); n != 2 {
+		t.Error("rate limited amount", n)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Sleep", 1, &res); e != nil {
+		t.Error("method without limit fail", e)
+	}
+
+	s.SetClientRateLimit(1, 1)
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Sleep", 1, &res); e != nil {
+		t.Error("call within client limit fail", e)
+	}
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Sleep", 1, &res); e == nil || e.Errno() != ErrRateLimited.Errno() {
+		t.Error("call over client limit should fail with 429", e)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	// count the calls failed with ErrServerOverload among 3 concurrent calls of 200ms,
+	// the first two are in flight before the third is sent
+	overloads := func(s *Server, c *Client) int {
+		var count int32
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var res int
+				if e := c.CallWithAddress("pipe", "TestRpcInt", "Sleep", 200, &res); e != nil {
+					if e.Errno() != ErrServerOverload.Errno() {
+						t.Error("call fail", e)
+					}
+					atomic.AddInt32(&count, 1)
+				}
+			}()
+			if i < 2 {
+				n := int64(i + 1)
+				waitFor(t, "calls in flight", func() bool { return atomic.LoadInt64(&s.inflight) == n })
+			}
+		}
+		wg.Wait()
+		return int(count)
+	}
+
+	s, c, _ := newPipeServerClient(t, func(s *Server) {
+		s.SetWorkerPool(2, 2)
+		replaced := s.workers
+		s.SetWorkerPool(1, 1)
+		select {
+		case <-replaced.done:
+		default:
+			t.Error("replaced worker pool not stopped")
+		}
+	}, nil)
+	if n := overloads(s, c); n != 1 {
+		t.Error("calls beyond the queue", n)
+	}
+	if n := atomic.LoadUint64(&s.status.OverloadAmount); n != 2 {
+		t.Error("overload amount with retry", n)
+	}
+	s.Close()
+	select {
+	case <-s.workers.done:
+	default:
+		t.Error("worker pool not stopped by Close")
+	}
+
+	s, c, _ = newPipeServerClient(t, nil, nil)
+	if err := s.SetMaxConcurrency("TestRpcInt", "Sleep", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMaxConcurrency("TestRpcInt", "None", 2); err == nil {
+		t.Error("max concurrency of unknown method should fail")
+	}
+	if n := overloads(s, c); n != 1 {
+		t.Error("calls beyond the max concurrency", n)
+	}
+
+	// the call expired in the queue is not executed
+	var invoked int32
+	s, c, _ = newPipeServerClient(t, func(s *Server) {
+		s.SetWorkerPool(1, 1)
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			if call.Method == "Repeat" {
+				atomic.AddInt32(&invoked, 1)
+			}
+			return invoke(call)
+		})
+	}, nil)
+	var ms int
+	call := c.GoWithAddress("pipe", "TestRpcInt", "Sleep", 200, &ms, nil)
+	waitFor(t, "call in flight", func() bool { return atomic.LoadInt64(&s.inflight) == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	var res string
+	if e := c.CallWithAddressContext(ctx, "pipe", "TestRpcInt", "Repeat", 1, &res); e == nil {
+		t.Error("call waiting in the queue should fail")
+	}
+	if call = <-call.Done; call.Error != nil {
+		t.Error("call fail", call.Error)
+	}
+	// the expired call is dequeued once the worker is free
+	waitFor(t, "expired call skipped", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	if n := atomic.LoadInt32(&invoked); n != 0 {
+		t.Error("expired call executed", n)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	_, c, _ := newPipeServerClient(t, nil, nil)
+
+	stream, e := c.StreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Count", 100)
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	for i := 0; ; i++ {
+		var n int
+		if err := stream.Recv(&n); err != nil {
+			if err != io.EOF || i != 100 {
+				t.Error("stream end", err, i)
+			}
+			break
+		}
+		if n != i {
+			t.Error("stream reply", n, i)
+		}
+		// calls share the connection with the stream
+		if i == 50 {
+			var res int
+			if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+				t.Error("call during stream", e, res)
+			}
+		}
+	}
+
+	stream, e = c.StreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Count", -1)
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	var n int
+	if err := stream.Recv(&n); err == nil || err.(*Error).Reason != "negative count" {
+		t.Error("stream error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, e = c.StreamWithAddress(ctx, "pipe", "TestRpcInt", "Count", 0)
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	time.AfterFunc(time.Millisecond*50, cancel)
+	if err := stream.Recv(&n); err == nil || err.(*Error).Errno() != ErrRequestCanceled.Errno() {
+		t.Error("canceled stream", err)
+	}
+	select {
+	case <-streamCanceled:
+	case <-time.After(time.Second):
+		t.Error("stream method not canceled")
+	}
+	if err := stream.Recv(&n); err != ErrStreamClosed {
+		t.Error("closed stream", err)
+	}
+
+	// the stream method is canceled with the context, the client not receiving
+	ctx, cancel = context.WithCancel(context.Background())
+	stream, e = c.StreamWithAddress(ctx, "pipe", "TestRpcInt", "Count", 0)
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	cancel()
+	select {
+	case <-streamCanceled:
+	case <-time.After(time.Second):
+		t.Error("stream method not canceled without Recv")
+	}
+	if err := stream.Recv(&n); err == nil || err.(*Error).Errno() != ErrRequestCanceled.Errno() {
+		t.Error("canceled stream", err)
+	}
+
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Count", 1, &res); e == nil || e.Errno() != ErrNotFound.Errno() {
+		t.Error("call stream method", e)
+	}
+	stream, e = c.StreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Update", 1)
+	if e != nil {
+		t.Fatal("stream fail", e)
+	}
+	if err := stream.Recv(&n); err == nil || err.(*Error).Errno() != ErrNotFound.Errno() {
+		t.Error("stream non-stream method", err)
+	}
+}
+
+func TestBidiStream(t *testing.T) {
+	_, c, _ := newPipeServerClient(t, nil, nil)
+
+	stream, e := c.OpenStreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Sum")
+	if e != nil {
+		t.Fatal("open stream fail", e)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := stream.Send(i); err != nil {
+			t.Fatal("send fail", err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Error("close send", err)
+	}
+	if err := stream.Send(1); err != ErrStreamClosed {
+		t.Error("send after close send", err)
+	}
+	var sum int
+	if err := stream.Recv(&sum); err != nil || sum != 5050 {
+		t.Error("sum", err, sum)
+	}
+	if err := stream.Recv(&sum); err != io.EOF {
+		t.Error("stream end", err)
+	}
+
+	// the client does not receive, both windows fill and the sending blocks
+	const frames = 800
+	value := strings.Repeat("a", 1024)
+	stream, e = c.OpenStreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Echo")
+	if e != nil {
+		t.Fatal("open stream fail", e)
+	}
+	var sent int32
+	go func() {
+		for i := 0; i < frames; i++ {
+			if err := stream.Send(value); err != nil {
+				t.Error("send fail", err)
+				return
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+		stream.CloseSend()
+	}()
+	waitFor(t, "send window exhausted", func() bool {
+		stream.send.Lock()
+		defer stream.send.Unlock()
+		return stream.send.window <= 0
+	})
+	if n := atomic.LoadInt32(&sent); n == frames {
+		t.Error("sending not blocked by the window", n)
+	}
+	// the blocked stream does not starve the calls on the connection
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil || res != 101 {
+		t.Error("call during blocked stream", e, res)
+	}
+	for i := 0; ; i++ {
+		var echo string
+		if err := stream.Recv(&echo); err != nil {
+			if err != io.EOF || i != frames {
+				t.Error("echo end", err, i)
+			}
+			break
+		}
+		if echo != value {
+			t.Error("echo", len(echo))
+		}
+	}
+
+	stream, e = c.OpenStreamWithAddress(context.Background(), "pipe", "TestRpcInt", "Count")
+	if e != nil {
+		t.Fatal("open stream fail", e)
+	}
+	if err := stream.Recv(&res); err == nil || err.(*Error).Errno() != ErrNotFound.Errno() {
+		t.Error("open server-streaming method", err)
+	}
+
+	// the stream method is canceled with the context, the client neither sending nor receiving
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, e = c.OpenStreamWithAddress(ctx, "pipe", "TestRpcInt", "Idle")
+	if e != nil {
+		t.Fatal("open stream fail", e)
+	}
+	if err := stream.Send(1); err != nil {
+		t.Fatal("send fail", err)
+	}
+	cancel()
+	select {
+	case <-idleCanceled:
+	case <-time.After(time.Second):
+		t.Error("stream method not canceled")
+	}
+	if err := stream.Send(1); err == nil || err.(*Error).Errno() != ErrRequestCanceled.Errno() {
+		t.Error("send on canceled stream", err)
+	}
+	if err := stream.CloseSend(); err == nil || err.(*Error).Errno() != ErrRequestCanceled.Errno() {
+		t.Error("close send of canceled stream", err)
+	}
+}
+
+func TestGoCall(t *testing.T) {
+	s, _, listener := newPipeServerClient(t, func(s *Server) {
+		s.SetRateLimit("TestRpcInt", "Update", 0.01, 1)
+	}, nil)
+	c := NewClient(NewNetOptions(time.Second, time.Millisecond*200, time.Millisecond*200))
+	c.AddServers([]*ServerOptions{NewServerOptions("pipe", 2, 2).SetDialer(listener.Dial)})
+
+	done := make(chan *Call, 50)
+	replies := make([]string, 50)
+	for i := 0; i < 50; i++ {
+		c.GoWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &replies[i], done)
+	}
+	for i := 0; i < 50; i++ {
+		call := <-done
+		if call.Error != nil || *call.Reply.(*string) != EchoContent {
+			t.Error("go call fail", call.Error, *call.Reply.(*string))
+		}
+	}
+
+	var res int
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "Sleep", 1000, &res, nil).Done; call.Error != ErrRequestTimeout {
+		t.Error("go call timeout", call.Error)
+	}
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "None", 1, &res, nil).Done; call.Error == nil || call.Error.Errno() != ErrNotFound.Errno() {
+		t.Error("go call unknown method", call.Error)
+	}
+	// the late reply after the timeout is dropped, not decoded into the reply
+	one := NewClient(NewNetOptions(time.Second, time.Millisecond*50, time.Millisecond*50))
+	one.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(listener.Dial)})
+	var slept int
+	if call := <-one.GoWithAddress("pipe", "TestRpcInt", "Sleep", 200, &slept, nil).Done; call.Error != ErrRequestTimeout {
+		t.Error("go call timeout", call.Error)
+	}
+	slept = -1
+	// the only connection reads the late reply before the reply of the next call
+	waitFor(t, "late reply sent", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	if e := one.CallWithAddress("pipe", "TestRpcInt", "Repeat", 1, new(string)); e != nil {
+		t.Error("call after timeout fail", e)
+	}
+	if slept != -1 {
+		t.Error("late reply is decoded into the reply of the timed out call", slept)
+	}
+	// retried once as the synchronous call
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "Update", 1, &res, nil).Done; call.Error != nil || res != 101 {
+		t.Error("go call", call.Error, res)
+	}
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "Update", 1, &res, nil).Done; call.Error == nil || call.Error.Errno() != ErrRateLimited.Errno() {
+		t.Error("go call over the rate limit", call.Error)
+	}
+	if n := atomic.LoadUint64(&s.status.RateLimitedAmount); n != 2 {
+		t.Error("go call retry", n)
+	}
+	if call := <-NewClient(NewNetOptions(time.Second, time.Second, time.Second)).Go("TestRpcInt", "Update", 1, &res, nil).Done; call.Error == nil || call.Error.Errno() != ErrInvalidAddress.Errno() {
+		t.Error("go call without servers", call.Error)
+	}
+
+	// the interceptors of the client see the go call and its result
+	var intercepted *Error
+	var methods []string
+	c.Use(func(call *ClientCall, invoke ClientInvoker) *Error {
+		methods = append(methods, call.Method)
+		intercepted = invoke(call)
+		return intercepted
+	})
+	var echo string
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "EchoStruct", TestABC{"aaa", "bbb", "ccc"}, &echo, nil).Done; call.Error != nil || echo != EchoContent {
+		t.Error("intercepted go call", call.Error, echo)
+	}
+	if call := <-c.GoWithAddress("pipe", "TestRpcInt", "None", 1, &res, nil).Done; call.Error == nil || call.Error != intercepted {
+		t.Error("interceptor not see the go call", call.Error, intercepted)
+	}
+	if len(methods) != 2 || methods[0] != "EchoStruct" || methods[1] != "None" {
+		t.Error("intercepted go calls", methods)
+	}
+}
+
+// counts the writes to the network
+type countingConn struct {
+	net.Conn
+	writes *int32
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestBatch(t *testing.T) {
+	s, _, listener := newPipeServerClient(t, nil, nil)
+	var writes int32
+	dialer := func(address string, connectTimeout time.Duration) (net.Conn, error) {
+		conn, err := listener.Dial(address, connectTimeout)
+		return countingConn{conn, &writes}, err
+	}
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(dialer)})
+	// open the connection
+	var res int
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Update", 1, &res); e != nil {
+		t.Fatal("call fail", e)
+	}
+
+	calls := make([]*BatchCall, 100)
+	replies := make([]string, len(calls))
+	for i := range calls {
+		calls[i] = &BatchCall{Service: "TestRpcInt", Method: "Repeat", Args: i % 10, Reply: &replies[i]}
+	}
+	calls[10].Method = "None"
+	calls[20].Reply = nil
+	before := atomic.LoadInt32(&writes)
+	errs := c.Batch("pipe", calls)
+	if n := atomic.LoadInt32(&writes) - before; n > 10 {
+		t.Error("batch writes", n)
+	}
+	for i, e := range errs {
+		switch i {
+		case 10:
+			if e == nil || e.Errno() != ErrNotFound.Errno() {
+				t.Error("batch unknown method", e)
+			}
+		case 20:
+			if e != nil {
+				t.Error("batch send only", e)
+			}
+		default:
+			if e != nil || replies[i] != strings.Repeat("gorpc ", i%10) {
+				t.Error("batch call", i, e, replies[i])
+			}
+		}
+	}
+
+	// beyond the pending queue of the connection
+	calls = make([]*BatchCall, MaxPendingRequest*3)
+	replies = make([]string, len(calls))
+	for i := range calls {
+		calls[i] = &BatchCall{Service: "TestRpcInt", Method: "Repeat", Args: i % 10, Reply: &replies[i]}
+	}
+	for i, e := range c.Batch("pipe", calls) {
+		if e != nil || replies[i] != strings.Repeat("gorpc ", i%10) {
+			t.Error("large batch call", i, e, replies[i])
+			break
+		}
+	}
+
+	calls = []*BatchCall{{Service: "TestRpcInt", Method: "Sleep", Args: 100, Reply: &res}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if errs := c.BatchContext(ctx, "pipe", calls); errs[0] == nil || errs[0].Errno() != ErrRequestCanceled.Errno() {
+		t.Error("batch canceled", errs[0])
+	}
+	// the late reply of the canceled call is dropped, the only connection reads it before the next reply
+	res = -1
+	waitFor(t, "late reply sent", func() bool { return atomic.LoadInt64(&s.inflight) == 0 })
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Repeat", 1, new(string)); e != nil {
+		t.Error("call after canceled batch fail", e)
+	}
+	if res != -1 {
+		t.Error("late reply is decoded into the reply of the canceled batch call", res)
+	}
+
+	// every call goes through the interceptors, the calls passed are sent together
+	var other int32
+	_, _, otherListener := newPipeServerClient(t, func(s *Server) {
+		s.Use(func(call *ServerCall, invoke ServerInvoker) *Error {
+			atomic.AddInt32(&other, 1)
+			return invoke(call)
+		})
+	}, nil)
+	c.AddServers([]*ServerOptions{NewServerOptions("other", 1, 1).SetDialer(otherListener.Dial)})
+	var intercepted int32
+	c.Use(func(call *ClientCall, invoke ClientInvoker) *Error {
+		atomic.AddInt32(&intercepted, 1)
+		if call.Args == -1 {
+			return NewError(10001, ErrTypeLogic, "negative argument")
+		}
+		if call.Args == 7 {
+			call.Address = "other"
+		}
+		return invoke(call)
+	})
+	calls = make([]*BatchCall, 10)
+	replies = make([]string, len(calls))
+	for i := range calls {
+		calls[i] = &BatchCall{Service: "TestRpcInt", Method: "Repeat", Args: i, Reply: &replies[i]}
+	}
+	calls[5].Args = -1
+	before = atomic.LoadInt32(&writes)
+	errs = c.Batch("pipe", calls)
+	if n := atomic.LoadInt32(&writes) - before; n > 2 {
+		t.Error("intercepted batch writes", n)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != int32(len(calls)) {
+		t.Error("intercepted calls", n)
+	}
+	if n := atomic.LoadInt32(&other); n != 1 {
+		t.Error("calls sent to the address rewritten", n)
+	}
+	for i, e := range errs {
+		if i == 5 {
+			if e == nil || e.Errno() != 10001 {
+				t.Error("batch short-circuited", e)
+			}
+		} else if e != nil || replies[i] != strings.Repeat("gorpc ", i) {
+			t.Error("intercepted batch call", i, e, replies[i])
+		}
+	}
+}
+
+type countingListener struct {
+	*PipeListener
+	writes *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.PipeListener.Accept()
+	return countingConn{conn, l.writes}, err
+}
+
+func TestWriteCoalesce(t *testing.T) {
+	listener := NewPipeListener()
+	var serverWrites, clientWrites int32
+	s := NewServerWithListener(countingListener{listener, &serverWrites})
+	s.Register(new(TestRpcInt))
+	s.SetWriteCoalesce(DefaultWriteCoalesceBytes, time.Millisecond*20)
+	go s.Serve()
+	defer s.Close()
+	dialer := func(address string, connectTimeout time.Duration) (net.Conn, error) {
+		conn, err := listener.Dial(address, connectTimeout)
+		return countingConn{conn, &clientWrites}, err
+	}
+	c := NewClient(NewNetOptions(time.Second, time.Second*2, time.Second*2))
+	c.AddServers([]*ServerOptions{NewServerOptions("pipe", 1, 1).SetDialer(dialer).SetWriteCoalesce(DefaultWriteCoalesceBytes, time.Millisecond*20)})
+	// open the connection
+	var res string
+	if e := c.CallWithAddress("pipe", "TestRpcInt", "Repeat", 1, &res); e != nil {
+		t.Fatal("call fail", e)
+	}
+
+	clientBefore, serverBefore := atomic.LoadInt32(&clientWrites), atomic.LoadInt32(&serverWrites)
+	done := make(chan *Call, 100)
+	replies := make([]string, cap(done))
+	for i := range replies {
+		c.GoWithAddress("pipe", "TestRpcInt", "Repeat", i%10, &replies[i], done)
+	}
+	for range replies {
+		if call := <-done; call.Error != nil {
+			t.Fatal("go call fail", call.Error)
+		}
+	}
+	for i, reply := range replies {
+		if reply != strings.Repeat("gorpc ", i%10) {
+			t.Error("coalesced reply", i, reply)
+		}
+	}
+	if n := atomic.LoadInt32(&clientWrites) - clientBefore; n > 20 {
+		t.Error("client writes", n)
+	}
+	if n := atomic.LoadInt32(&serverWrites) - serverBefore; n > 20 {
+		t.Error("server writes", n)
+	}
+}
+
+// the client ignoring the window is reset once it sends beyond the window
+func TestStreamWindowExceeded(t *testing.T) {
+	_, _, listener := newPipeServerClient(t, nil, nil)
+	conn, err := listener.Dial("pipe", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := clientHandshake(conn, &Handshake{Version: HandshakeVersion, Codec: GobCodec}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	rpcConn := NewConnDriver(conn, nil, NewGobCodec())
+	reset := make(chan *Error, 1)
+	go func() {
+		for {
+			respHeader := NewResponseHeader()
+			if err := rpcConn.ReadResponseHeader(respHeader); err != nil {
+				return
+			}
+			if respHeader.Error != nil {
+				reset <- respHeader.Error
+				return
+			}
+		}
+	}()
+
+	request := NewRequest()
+	request.header.Seq = 1
+	request.header.Service = "TestRpcInt"
+	request.header.Method = "Hold"
+	request.header.CallType = RequestOpenStream
+	if err := rpcConn.WriteRequest(request.header, nil); err != nil {
+		t.Fatal(err)
+	}
+	send := newStreamSend(rpcConn.codec)
+	body, _ := send.encode(strings.Repeat("a", 1024))
+	for sent := 0; sent <= DefaultStreamWindow+len(body); sent += len(body) {
+		request = NewRequest()
+		request.header.Seq = 1
+		request.header.CallType = RequestStreamData
+		if err := rpcConn.WriteRequest(request.header, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := rpcConn.FlushWriteToNet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case e := <-reset:
+		if e.Errno() != ErrFlowControl.Errno() {
+			t.Error("stream reset", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("stream not reset beyond the window")
+	}
+}
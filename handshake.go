@@ -0,0 +1,144 @@
+package gorpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// the client and the server exchange a handshake before the first frame:
+//
+//	magic        4 bytes  0x47524853 "GRHS"
+//	size         4 bytes  big-endian
+//
+// followed by the json of Handshake. the server replies the negotiated
+// settings, or the *Error rejecting the connection before closing it
+const (
+	HandshakeMagic   = 0x47524853
+	HandshakeVersion = 1 // version of the wire format spoken by this package
+	// oldest version of the peer accepted
+	MinHandshakeVersion = 1
+	MaxHandshakeSize    = 4096
+)
+
+// feature flags, a feature is used only if both ends support it
+const (
+	// the server sends goaway before shutting down
+	FeatureGoAway = 1 << iota
+)
+
+// features supported by this package
+const SupportedFeatures = FeatureGoAway
+
+var (
+	errHandshakeMagic = errors.New("gorpc: invalid handshake magic")
+	errHandshakeSize  = errors.New("gorpc: handshake too large")
+)
+
+type Handshake struct {
+	Version int `json:"version"`
+	Codec   int `json:"codec"`
+	// the compressions supported by the client in preference order,
+	// the server replies the one chosen, none if empty
+	Compressions []string `json:"compressions,omitempty"`
+	// max body size of the frames accepted by the sender
+	MaxFrameSize int    `json:"max_frame_size"`
+	Features     uint64 `json:"features"`
+	// credentials of the client checked by the Authenticator of the server
+	Token string `json:"token,omitempty"`
+	// set by the server rejecting the connection
+	Error *Error `json:"error,omitempty"`
+}
+
+func writeHandshake(w io.Writer, hs *Handshake) error {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(b[0:4], HandshakeMagic)
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(data)))
+	copy(b[8:], data)
+	_, err = w.Write(b)
+	return err
+}
+
+func readHandshake(r io.Reader, hs *Handshake) error {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(head[0:4]) != HandshakeMagic {
+		return errHandshakeMagic
+	}
+	size := binary.BigEndian.Uint32(head[4:8])
+	if size > MaxHandshakeSize {
+		return errHandshakeSize
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, hs)
+}
+
+// send the handshake of the client and read the reply of the server within timeout,
+// the *Error of the server is returned if the connection is rejected
+func clientHandshake(conn net.Conn, hs *Handshake, timeout time.Duration) (*Handshake, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := writeHandshake(conn, hs); err != nil {
+		return nil, err
+	}
+	reply := &Handshake{}
+	if err := readHandshake(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	if reply.Version < MinHandshakeVersion {
+		return nil, ErrHandshakeVersion.SetReason(fmt.Sprintf("%s: %d replied, min version: %d", ErrHandshakeVersion.Reason, reply.Version, MinHandshakeVersion))
+	}
+	if reply.Codec != hs.Codec {
+		return nil, ErrHandshakeCodec.SetReason(fmt.Sprintf("%s: %d replied, codec requested: %d", ErrHandshakeCodec.Reason, reply.Codec, hs.Codec))
+	}
+	return reply, nil
+}
+
+// negotiate the settings of the connection with the handshake of the client,
+// principal is the client authenticated, nil if no Authenticator
+func (server *Server) handshake(hs *Handshake, remoteAddr net.Addr) (reply *Handshake, principal *Principal) {
+	reply = &Handshake{
+		Version:      HandshakeVersion,
+		Codec:        server.codec.Id(),
+		MaxFrameSize: server.maxRequestSize,
+		Features:     hs.Features & SupportedFeatures,
+	}
+	if hs.Version < MinHandshakeVersion {
+		reply.Error = ErrHandshakeVersion.SetReason(fmt.Sprintf("%s: %d, min version: %d", ErrHandshakeVersion.Reason, hs.Version, MinHandshakeVersion))
+		return reply, nil
+	}
+	if hs.Version < reply.Version {
+		reply.Version = hs.Version
+	}
+	if hs.Codec != server.codec.Id() {
+		reply.Error = ErrHandshakeCodec.SetReason(fmt.Sprintf("%s: %d, server codec: %s", ErrHandshakeCodec.Reason, hs.Codec, server.codec.Name()))
+		return reply, nil
+	}
+	if server.authenticator != nil {
+		var err error
+		if principal, err = server.authenticator.Authenticate(hs.Token, remoteAddr); err != nil {
+			reply.Error = ErrUnauthenticated.SetReason(ErrUnauthenticated.Reason + ": " + err.Error())
+			return reply, nil
+		}
+	}
+	if compressor := negotiateCompressor(hs.Compressions); compressor != nil {
+		reply.Compressions = []string{compressor.Name()}
+	}
+	return reply, principal
+}
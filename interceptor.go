@@ -0,0 +1,112 @@
+package gorpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"time"
+)
+
+// ServerCall is a call being served by the server, it is passed through the server interceptors
+type ServerCall struct {
+	Context    context.Context
+	RemoteAddr net.Addr
+	Principal  *Principal // authenticated client, nil without Authenticator
+	Caller     string     // identity claimed by the client, not verified
+	Service    string
+	Method     string
+	Seq        uint64
+	Meta       map[string]string // sent by the client interceptors
+	Arg        interface{}       // decoded argument
+	Reply      interface{}       // pointer to the reply, filled by the service
+
+	service    *service
+	methodType *methodType
+	argv       reflect.Value
+	replyv     reflect.Value
+	deadline   time.Time
+	compress   int8 // compression mode of the reply
+}
+
+// ServerInvoker executes the call, the innermost one invokes the service method
+type ServerInvoker func(call *ServerCall) *Error
+
+// ServerInterceptor wraps the invocation of the services. it calls invoke to go on
+// and sees the *Error returned by the service, or returns an *Error without calling
+// invoke to short-circuit the call.
+type ServerInterceptor func(call *ServerCall, invoke ServerInvoker) *Error
+
+// add interceptors before Serve, the first added is the outermost
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.interceptors = append(server.interceptors, interceptors...)
+	invoker := invokeService
+	for i := len(server.interceptors) - 1; i >= 0; i-- {
+		invoker = chainServerInterceptor(server.interceptors[i], invoker)
+	}
+	server.invoker = invoker
+}
+
+func chainServerInterceptor(interceptor ServerInterceptor, next ServerInvoker) ServerInvoker {
+	return func(call *ServerCall) *Error {
+		return interceptor(call, next)
+	}
+}
+
+// invoke the service method of the call
+func invokeService(call *ServerCall) *Error {
+	returnValues := call.methodType.call(call.Context, call.service, call.argv, call.replyv)
+	// The return value for the method is an error.
+	return toRpcError(returnValues[0].Interface())
+}
+
+// convert the error returned by the service to *Error
+func toRpcError(errInter interface{}) *Error {
+	switch e := errInter.(type) {
+	case *Error:
+		return e
+	case Error:
+		return &e
+	case error:
+		return &Error{500, ErrTypeLogic, e.Error()}
+	}
+	return nil
+}
+
+// ClientCall is a call made by the client, it is passed through the client interceptors
+type ClientCall struct {
+	Context context.Context
+	Address string // server address given to CallWithAddress or chosen by Call
+	Service string
+	Method  string
+	Args    interface{}
+	Reply   interface{}
+	Meta    map[string]string // sent to the server in the request header, such as tracing id
+	Caller  string            // identity sent to the server for the authorization, Client.SetCaller by default
+	Retries int               // times the call retried, set by the innermost invoker
+}
+
+// ClientInvoker executes the call, the innermost one sends it to the server and waits the response
+type ClientInvoker func(call *ClientCall) *Error
+
+// ClientInterceptor wraps the calls of the client. it calls invoke to go on and sees
+// the final *Error after retries, or returns an *Error without calling invoke to
+// short-circuit the call.
+type ClientInterceptor func(call *ClientCall, invoke ClientInvoker) *Error
+
+// add interceptors before calling, the first added is the outermost
+func (this *Client) Use(interceptors ...ClientInterceptor) {
+	this.Lock()
+	this.interceptors = append(this.interceptors, interceptors...)
+	invoker := this.invoke
+	for i := len(this.interceptors) - 1; i >= 0; i-- {
+		invoker = chainClientInterceptor(this.interceptors[i], invoker)
+	}
+	this.invoker = invoker
+	this.Unlock()
+}
+
+func chainClientInterceptor(interceptor ClientInterceptor, next ClientInvoker) ClientInvoker {
+	return func(call *ClientCall) *Error {
+		return interceptor(call, next)
+	}
+}
@@ -22,11 +22,16 @@ func (cs *ClientStatus) ReadAmount() uint64 {
 }
 
 type ServerStatus struct {
-	CallAmount  uint64
-	WriteAmount uint64
-	ErrorAmount uint64
-	ReadBytes   uint64
-	WriteBytes  uint64
+	CallAmount        uint64
+	WriteAmount       uint64
+	ErrorAmount       uint64
+	ReadBytes         uint64
+	WriteBytes        uint64
+	PanicAmount       uint64
+	EncodeErrorAmount uint64 // replies failed to encode
+	DeniedAmount      uint64 // calls denied by the authorizer
+	RateLimitedAmount uint64 // calls over the rate limits
+	OverloadAmount    uint64 // calls beyond the worker queue or the max concurrency
 }
 
 type ServerStatusPerSecond struct {
@@ -42,6 +47,26 @@ func (ss *ServerStatus) IncrErrorAmount() {
 	atomic.AddUint64(&ss.ErrorAmount, 1)
 }
 
+func (ss *ServerStatus) IncrPanicAmount() {
+	atomic.AddUint64(&ss.PanicAmount, 1)
+}
+
+func (ss *ServerStatus) IncrEncodeErrorAmount() {
+	atomic.AddUint64(&ss.EncodeErrorAmount, 1)
+}
+
+func (ss *ServerStatus) IncrDeniedAmount() {
+	atomic.AddUint64(&ss.DeniedAmount, 1)
+}
+
+func (ss *ServerStatus) IncrRateLimitedAmount() {
+	atomic.AddUint64(&ss.RateLimitedAmount, 1)
+}
+
+func (ss *ServerStatus) IncrOverloadAmount() {
+	atomic.AddUint64(&ss.OverloadAmount, 1)
+}
+
 func (ss *ServerStatus) IncrReadBytes(bytes uint64) {
 	atomic.AddUint64(&ss.ReadBytes, bytes)
 }
@@ -73,6 +98,11 @@ func (ss *ServerStatus) Status() *ServerStatusPerSecond {
 	status.Result["ErrorAmount"] = atomic.LoadUint64(&ss.ErrorAmount)
 	status.Result["ReadBytes"] = atomic.LoadUint64(&ss.ReadBytes)
 	status.Result["WriteBytes"] = atomic.LoadUint64(&ss.WriteBytes)
+	status.Result["PanicAmount"] = atomic.LoadUint64(&ss.PanicAmount)
+	status.Result["EncodeErrorAmount"] = atomic.LoadUint64(&ss.EncodeErrorAmount)
+	status.Result["DeniedAmount"] = atomic.LoadUint64(&ss.DeniedAmount)
+	status.Result["RateLimitedAmount"] = atomic.LoadUint64(&ss.RateLimitedAmount)
+	status.Result["OverloadAmount"] = atomic.LoadUint64(&ss.OverloadAmount)
 	status.Result["Call/s"] = status.Result["CallAmount"] - callAmount
 	status.Result["Err/s"] = status.Result["ErrorAmount"] - errAmount
 	status.Result["ReadBytes/s"] = status.Result["ReadBytes"] - readBytes
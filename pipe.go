@@ -0,0 +1,80 @@
+package gorpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errPipeListenerClosed = errors.New("gorpc: pipe listener closed")
+	errPipeDialTimeout    = errors.New("gorpc: pipe dial timeout")
+)
+
+// PipeListener is an in-memory transport without binding ports, the connections
+// are the ends of net.Pipe. serve it by NewServerWithListener, and connect it by
+// ServerOptions.SetDialer(listener.Dial):
+//
+//	listener := gorpc.NewPipeListener()
+//	s := gorpc.NewServerWithListener(listener)
+//	client.AddServers([]*gorpc.ServerOptions{gorpc.NewServerOptions("pipe", 1, 1).SetDialer(listener.Dial)})
+type PipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial returns the client end of a new connection, the address is ignored
+func (l *PipeListener) Dial(address string, connectTimeout time.Duration) (net.Conn, error) {
+	client, server := net.Pipe()
+	var err error
+	timer := time.NewTimer(connectTimeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = errPipeListenerClosed
+	case <-timer.C:
+		err = errPipeDialTimeout
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
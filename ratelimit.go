@@ -0,0 +1,114 @@
+package gorpc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate calls per second with bursts up to burst calls
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// the buckets full again have been idle, they are dropped
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// rateLimiter keeps the buckets of the remote hosts, the services and the methods
+type rateLimiter struct {
+	sync.RWMutex
+	calls       map[string]*tokenBucket // keyed by service or service.method
+	clientRate  float64
+	clientBurst int
+	clients     map[string]*tokenBucket // keyed by remote host
+	sweepTime   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		calls:   make(map[string]*tokenBucket),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// allow the call of the method from addr, reason tells the limit exceeded
+func (rl *rateLimiter) allow(addr net.Addr, service, method string) (ok bool, reason string) {
+	now := time.Now()
+	rl.RLock()
+	limitClient := rl.clientRate > 0
+	serviceBucket := rl.calls[service]
+	methodBucket := rl.calls[accessKey(service, method)]
+	rl.RUnlock()
+	if limitClient && addr != nil && !rl.client(addr, now).allow(now) {
+		return false, "client " + remoteHost(addr)
+	}
+	if serviceBucket != nil && !serviceBucket.allow(now) {
+		return false, "service " + service
+	}
+	if methodBucket != nil && !methodBucket.allow(now) {
+		return false, "method " + service + "." + method
+	}
+	return true, ""
+}
+
+func (rl *rateLimiter) client(addr net.Addr, now time.Time) *tokenBucket {
+	host := remoteHost(addr)
+	rl.RLock()
+	bucket := rl.clients[host]
+	rl.RUnlock()
+	if bucket != nil {
+		return bucket
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	if bucket = rl.clients[host]; bucket != nil {
+		return bucket
+	}
+	// drop the buckets of the clients gone, at most once per RateLimitSweepInterval
+	if now.Sub(rl.sweepTime) > RateLimitSweepInterval {
+		rl.sweepTime = now
+		for h, b := range rl.clients {
+			if b.idle(now) {
+				delete(rl.clients, h)
+			}
+		}
+	}
+	bucket = newTokenBucket(rl.clientRate, rl.clientBurst)
+	rl.clients[host] = bucket
+	return bucket
+}
+
+// the host of the remote address, the connections of a client share its limit
+func remoteHost(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -6,7 +6,19 @@ import (
 )
 
 const (
-	RequestSendOnly   int16 = 1
+	RequestSendOnly int16 = 1
+	// open a stream replied by many data frames
+	RequestStream int16 = 2
+	// cancel the stream of the seq, no body
+	RequestCancel int16 = 3
+	// open a client or bidirectional stream, no body
+	RequestOpenStream int16 = 4
+	// a data frame sent on the stream of the seq
+	RequestStreamData int16 = 5
+	// the client sends no more data frames on the stream of the seq, no body
+	RequestCloseSend int16 = 6
+	// the client grants the stream of the seq Window more bytes to send, no body
+	RequestWindow     int16 = 7
 	MaxPendingRequest int   = 500
 )
 
@@ -15,6 +27,8 @@ type Request struct {
 	body         interface{}
 	writeTimeout time.Duration
 	readTimeout  time.Duration
+	deadline     time.Time // caller stops waiting at deadline, zero means never
+	batched      bool      // more requests of the batch follow, flushed with the last one
 	pending      int32
 }
 
@@ -34,17 +48,61 @@ func (request *Request) freePending() {
 	atomic.AddInt32(&request.pending, -1)
 }
 
+// set the remaining time of the caller to the header before writing the request,
+// return false if the caller has stopped waiting
+func (request *Request) setTimeout() bool {
+	if request.deadline.IsZero() {
+		return true
+	}
+	remaining := time.Until(request.deadline)
+	if remaining <= 0 {
+		return false
+	}
+	request.header.Timeout = int64(remaining)
+	return true
+}
+
 type RequestHeader struct {
 	Service  string
 	Method   string
 	Seq      uint64
 	CallType int16
+	Timeout  int64             // nanoseconds the caller still waits for the reply, 0 means no limit
+	Meta     map[string]string // set by the client interceptors
+	Compress int8              // compression mode of the request and its reply
+	Caller   string            // identity of the caller for the authorization, not verified
+	Window   uint32            // bytes granted by RequestWindow
+}
+
+// the time after which the caller stops waiting, zero time means no limit
+func (reqheader *RequestHeader) Deadline(received time.Time) time.Time {
+	if reqheader.Timeout <= 0 {
+		return time.Time{}
+	}
+	return received.Add(time.Duration(reqheader.Timeout))
 }
 
 func NewRequestHeader() *RequestHeader {
 	return &RequestHeader{}
 }
 
+func (reqheader *RequestHeader) hasBody() bool {
+	switch reqheader.CallType {
+	case RequestCancel, RequestOpenStream, RequestCloseSend, RequestWindow:
+		return false
+	}
+	return !reqheader.IsPing()
+}
+
+// the frame belongs to a stream already open
+func (reqheader *RequestHeader) isStreamFrame() bool {
+	switch reqheader.CallType {
+	case RequestCancel, RequestStreamData, RequestCloseSend, RequestWindow:
+		return true
+	}
+	return false
+}
+
 func (reqheader *RequestHeader) IsPing() bool {
 	if reqheader.Service == "go" && reqheader.Method == "p" {
 		return true
@@ -1,21 +1,39 @@
 package gorpc
 
 const (
-	ReplyTypeData = 0x01
-	ReplyTypePong = 0x10
-	ReplyTypeAck  = 0x100
+	ReplyTypeData   = 0x01
+	ReplyTypeGoAway = 0x02 // server is shutting down, send no more requests
+	// a data frame of a stream, the stream stays open
+	ReplyTypeStream = 0x04
+	// the stream ends, with the error of the handler if any
+	ReplyTypeStreamEnd = 0x08
+	ReplyTypePong      = 0x10
+	// the server grants the stream Window more bytes to send, no body
+	ReplyTypeWindow = 0x20
+	ReplyTypeAck    = 0x100
 )
 
 type ResponseHeader struct {
 	Error     *Error
 	Seq       uint64
 	ReplyType int16
+	Window    uint32 // bytes granted by ReplyTypeWindow
+	compress  int8   // compression mode of the reply, following the request
 }
 
 func (respHeader *ResponseHeader) HaveReply() bool {
 	return (respHeader.ReplyType & ReplyTypeData) > 0
 }
 
+func (respHeader *ResponseHeader) isStreamData() bool {
+	return (respHeader.ReplyType & ReplyTypeStream) > 0
+}
+
+// the frame keeps the stream open
+func (respHeader *ResponseHeader) isStreamFrame() bool {
+	return (respHeader.ReplyType & (ReplyTypeStream | ReplyTypeWindow)) > 0
+}
+
 func NewResponseHeader() *ResponseHeader {
 	return &ResponseHeader{}
 }
@@ -26,8 +44,19 @@ type PendingResponse struct {
 	reply  interface{}
 	done   chan bool
 	err    *Error
+	stream *Stream // receives the frames of a stream call
+	call   *Call   // the asynchronous call, notified instead of done
 }
 
 func NewPendingResponse() *PendingResponse {
 	return &PendingResponse{done: make(chan bool, 1)}
 }
+
+// the response is received or the connection is broken, err is set
+func (presp *PendingResponse) complete() {
+	if presp.call != nil {
+		presp.call.complete(presp)
+		return
+	}
+	presp.done <- true
+}
@@ -1,23 +1,30 @@
 package gorpc
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 const (
-	GobCodec    = 1
 	CmdTypePing = "ping"
 	CmdTypeErr  = "err"
 	CmdTypeAck  = "ack"
+	// tell the client to stop sending new requests on the connection
+	CmdTypeGoAway = "goaway"
 )
 
 const (
@@ -55,12 +62,41 @@ func (tp *TimerPool) RemoveConn(conn *ConnDriver) {
 
 }
 
+// snapshot of all the connections in the pool
+func (tp *TimerPool) Conns() []*ConnDriver {
+	conns := make([]*ConnDriver, 0)
+	for _, pool := range tp {
+		pool.RLock()
+		for _, conn := range pool.conns {
+			conns = append(conns, conn)
+		}
+		pool.RUnlock()
+	}
+	return conns
+}
+
 type Server struct {
-	serviceMap map[string]*service
-	listener   *net.TCPListener
-	codec      int
-	status     *ServerStatus
-	timerPool  *TimerPool
+	serviceMap     map[string]*service
+	listener       net.Listener
+	rawListener    net.Listener // the listener before SetTLSConfig wraps it
+	codec          Codec
+	status         *ServerStatus
+	timerPool      *TimerPool
+	maxRequestSize int
+	compressMin    int // replies smaller than it are sent raw
+	coalesceBytes  int
+	coalesceDelay  time.Duration
+	interceptors   []ServerInterceptor
+	invoker        ServerInvoker // interceptors chained with the service
+	panicHandler   PanicHandler
+	authenticator  Authenticator
+	authorizer     Authorizer
+	rateLimiter    *rateLimiter
+	workers        *workerPool   // nil means a goroutine per call
+	inflight       int64         // services being executed
+	shutdown       int32         // set to 1 when Shutdown is called
+	done           chan struct{} // closed when the listener is closed
+	closeOnce      sync.Once
 }
 
 func NewServer(Address string) *Server {
@@ -72,12 +108,24 @@ func NewServer(Address string) *Server {
 	if err != nil {
 		panic("NewServer error:" + err.Error())
 	}
+	return NewServerWithListener(listener)
+}
+
+// serve the connections accepted by listener, such as a unix socket listener
+func NewServerWithListener(listener net.Listener) *Server {
 	s := &Server{
-		serviceMap: make(map[string]*service),
-		listener:   listener,
-		codec:      GobCodec,
-		status:     &ServerStatus{},
-		timerPool:  NewTimerPool(),
+		serviceMap:     make(map[string]*service),
+		listener:       listener,
+		rawListener:    listener,
+		codec:          NewGobCodec(),
+		status:         &ServerStatus{},
+		timerPool:      NewTimerPool(),
+		maxRequestSize: DefaultMaxRequestSize,
+		compressMin:    DefaultCompressThreshold,
+		coalesceBytes:  DefaultWriteCoalesceBytes,
+		rateLimiter:    newRateLimiter(),
+		invoker:        invokeService,
+		done:           make(chan struct{}),
 	}
 	s.Register(&RpcStatus{s})
 	go s.GCTimer()
@@ -89,21 +137,210 @@ func (server *Server) Serve() {
 		conn, err := server.listener.Accept()
 		if err != nil {
 			//log.Print("Serv:", err.Error())
+			select {
+			case <-server.done:
+				return
+			default:
+			}
 			continue
 		}
-		connTcp := conn.(*net.TCPConn)
-		go server.serveConn(connTcp)
+		go server.serveConn(conn)
 	}
 }
 
+// set the codec of the server before Serve, the connections using other codecs are rejected.
+// return error if the codec can not serialize the registered methods
+func (server *Server) SetCodec(codec Codec) error {
+	for sname, s := range server.serviceMap {
+		for mname, err := range invalidMethods(codec, s.method) {
+			return errors.New("rpc.SetCodec: " + codec.Name() + " can not serve " + sname + "." + mname + ": " + err.Error())
+		}
+	}
+	server.codec = codec
+	return nil
+}
+
+// PanicHandler captures the panic of the service, stack is the trace of the panicking goroutine
+type PanicHandler func(call *ServerCall, v interface{}, stack []byte)
+
+// set handler before Serve to report the panics of services, the panics are logged by default
+func (server *Server) SetPanicHandler(handler PanicHandler) {
+	server.panicHandler = handler
+}
+
+// the replies smaller than size are sent raw on the connections negotiated compression,
+// DefaultCompressThreshold by default
+func (server *Server) SetCompressThreshold(size int) {
+	server.compressMin = size
+}
+
+// flush the replies up to maxBytes together before Serve, a reply waits up to maxDelay for more.
+// the replies of the concurrent calls are flushed together even without delay
+func (server *Server) SetWriteCoalesce(maxBytes int, maxDelay time.Duration) {
+	server.coalesceBytes = maxBytes
+	server.coalesceDelay = maxDelay
+}
+
+// authenticate the new connections by authenticator before Serve, the connections
+// failing it are rejected and the calls after the principal expires fail with ErrUnauthenticated
+func (server *Server) SetAuthenticator(authenticator Authenticator) {
+	server.authenticator = authenticator
+}
+
+// check every call by authorizer before decoding the argument, such as an AccessPolicy.
+// the calls denied fail with ErrForbidden
+func (server *Server) SetAuthorizer(authorizer Authorizer) {
+	server.authorizer = authorizer
+}
+
+// limit the calls of every remote host to rate per second with bursts up to burst,
+// set before Serve. the calls over the limit fail with ErrRateLimited, rate 0 means no limit
+func (server *Server) SetClientRateLimit(rate float64, burst int) {
+	server.rateLimiter.Lock()
+	server.rateLimiter.clientRate = rate
+	server.rateLimiter.clientBurst = burst
+	server.rateLimiter.clients = make(map[string]*tokenBucket)
+	server.rateLimiter.Unlock()
+}
+
+// limit the calls of the service, or the method of the service if method is not empty,
+// to rate per second with bursts up to burst. rate 0 removes the limit
+func (server *Server) SetRateLimit(service, method string, rate float64, burst int) {
+	server.rateLimiter.Lock()
+	if rate > 0 {
+		server.rateLimiter.calls[accessKey(service, method)] = newTokenBucket(rate, burst)
+	} else {
+		delete(server.rateLimiter.calls, accessKey(service, method))
+	}
+	server.rateLimiter.Unlock()
+}
+
+// execute the calls by workers goroutines, the calls beyond queueSize waiting for
+// a worker fail with ErrServerOverload. set before Serve, a goroutine per call by default.
+// the pool set earlier is stopped
+func (server *Server) SetWorkerPool(workers, queueSize int) {
+	if server.workers != nil {
+		server.workers.stop()
+	}
+	server.workers = newWorkerPool(workers, queueSize)
+}
+
+// limit the calls of the method executing at the same time, the calls beyond it fail
+// with ErrServerOverload before decoding the argument. n 0 means no limit
+func (server *Server) SetMaxConcurrency(service, method string, n int) error {
+	s := server.serviceMap[service]
+	if s == nil || s.method[method] == nil {
+		return errors.New("rpc.SetMaxConcurrency: method " + service + "." + method + " not registered")
+	}
+	atomic.StoreInt32(&s.method[method].maxRunning, int32(n))
+	return nil
+}
+
+// serve the connections over tls, set before Serve. set ClientAuth and ClientCAs
+// of config to verify the client certificates, use CertReloader to reload the
+// certificate without restarting the server. the config set later replaces the earlier one
+func (server *Server) SetTLSConfig(config *tls.Config) {
+	server.listener = tls.NewListener(server.rawListener, config)
+}
+
+// the request whose body exceeds size is replied with ErrRequestTooLarge without decoding
+func (server *Server) SetMaxRequestSize(size int) {
+	server.maxRequestSize = size
+}
+
+// stop accepting connections and stop the worker pool, the calls still queued are rejected
 func (server *Server) Close() error {
+	err := server.closeListener()
+	if server.workers != nil {
+		server.workers.stop()
+	}
+	return err
+}
+
+func (server *Server) closeListener() error {
+	server.closeOnce.Do(func() { close(server.done) })
 	return server.listener.Close()
 }
 
+// Shutdown gracefully stops the server. It stops accepting connections, tells
+// every connected client to stop sending new requests, waits for the services
+// in execution to reply, stops the timer-gc goroutines and closes all the
+// connections. If ctx is done before the services finish, the connections
+// are closed anyway and ctx.Err() is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&server.shutdown, 0, 1) {
+		return errors.New("gorpc: server already shut down")
+	}
+	// the calls queued are still executed until ctx is done
+	err := server.closeListener()
+	for _, conn := range server.timerPool.Conns() {
+		if conn.features&FeatureGoAway > 0 {
+			server.replyCmd(conn, 0, nil, CmdTypeGoAway)
+		}
+	}
+	ticker := time.NewTicker(ShutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&server.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			goto final
+		case <-ticker.C:
+		}
+	}
+final:
+	// the calls still queued are rejected before the connections are closed
+	if server.workers != nil {
+		server.workers.stop()
+	}
+	for _, conn := range server.timerPool.Conns() {
+		// the replies buffered for the delayed flush are written before closing
+		conn.Lock()
+		conn.flushArmed = false
+		server.flush(conn)
+		conn.Unlock()
+		server.closeConn(conn, ErrServerShutdown)
+	}
+	return err
+}
+
+func (server *Server) isShutdown() bool {
+	return atomic.LoadInt32(&server.shutdown) == 1
+}
+
 // serve  read write deadline-timer of conn
-func (server *Server) serveConn(conn *net.TCPConn) {
-	rpcConn := NewConnDriver(conn, server)
+func (server *Server) serveConn(conn net.Conn) {
+	var hs Handshake
+	conn.SetDeadline(time.Now().Add(DefaultServerHandshakeTimeout))
+	if err := readHandshake(conn, &hs); err != nil {
+		log.Println("handshake error:", err, "remote:", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	reply, principal := server.handshake(&hs, conn.RemoteAddr())
+	if err := writeHandshake(conn, reply); err != nil || reply.Error != nil {
+		if reply.Error != nil {
+			log.Println("reject connection from", conn.RemoteAddr(), reply.Error.Reason)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	rpcConn := NewConnDriver(conn, server, server.codec)
+	rpcConn.maxBodySize = server.maxRequestSize
+	rpcConn.peerMaxBodySize = hs.MaxFrameSize
+	rpcConn.features = reply.Features
+	rpcConn.principal = principal
+	rpcConn.setWriteCoalesce(server.coalesceBytes, server.coalesceDelay)
+	if len(reply.Compressions) > 0 {
+		rpcConn.compressor = CompressorByName(reply.Compressions[0])
+		rpcConn.compressMin = server.compressMin
+	}
 	server.timerPool.AddConn(rpcConn)
+	// accepted while shutting down, missed by Shutdown
+	if server.isShutdown() {
+		rpcConn.Close()
+	}
 	server.ServeLoop(rpcConn)
 	server.timerPool.RemoveConn(rpcConn)
 }
@@ -131,7 +368,11 @@ func (server *Server) GCTimer() {
 					conn.Close()
 				}
 				connsTimeout = connsTimeout[0:0]
-				time.Sleep(DefaultServerTimerGCInterval)
+				select {
+				case <-server.done:
+					return
+				case <-time.After(DefaultServerTimerGCInterval):
+				}
 			}
 
 		}(server.timerPool[i])
@@ -144,6 +385,7 @@ func (server *Server) ServeLoop(conn *ConnDriver) {
 	var err error
 	var methodType *methodType
 	var service *service
+	var deadline time.Time
 	for {
 		reqHeader := NewRequestHeader()
 		if err = conn.SetReadDeadline(time.Now().Add(DefaultServerIdleTimeout)); err != nil {
@@ -153,58 +395,146 @@ func (server *Server) ServeLoop(conn *ConnDriver) {
 		if err != nil {
 			goto fail
 		}
+		// the frames of the streams open are routed to their handlers by seq
+		if reqHeader.isStreamFrame() {
+			if !server.readStreamFrame(conn, reqHeader) {
+				goto fail
+			}
+			continue
+		}
+		deadline = reqHeader.Deadline(time.Now())
 		server.status.IncrCallAmount()
 		if reqHeader.IsPing() {
 			server.replyCmd(conn, reqHeader.Seq, nil, CmdTypePing)
 			continue
 		}
+		if server.authenticator != nil && !conn.principal.valid(time.Now()) {
+			if !server.rejectCall(conn, reqHeader, ErrUnauthenticated.SetReason(ErrUnauthenticated.Reason+": credentials expired")) {
+				goto fail
+			}
+			continue
+		}
 		// verify service and method
 		service = server.serviceMap[reqHeader.Service]
 		if service != nil {
 			methodType = service.method[reqHeader.Method]
 		}
 		if service == nil || methodType == nil {
-			err = conn.ReadRequestBody(nil)
-			if err != nil {
+			if !server.rejectCall(conn, reqHeader, ErrNotFound) {
 				goto fail
 			}
-			server.replyCmd(conn, reqHeader.Seq, ErrNotFound, CmdTypeErr)
 			continue
 		}
-
-		var argv, replyv reflect.Value
-		// Decode the argument value.
-		argIsValue := false // if true, need to indirect before calling.
-		if methodType.ArgType.Kind() == reflect.Ptr {
-			argv = reflect.New(methodType.ArgType.Elem())
-		} else {
-			argv = reflect.New(methodType.ArgType)
-			argIsValue = true
+		if !methodType.accept(reqHeader.CallType) {
+			if !server.rejectCall(conn, reqHeader, ErrNotFound.SetReason(ErrNotFound.Reason+": call type not match the method")) {
+				goto fail
+			}
+			continue
 		}
-		err = conn.ReadRequestBody(argv.Interface())
-		if err != nil {
-			if isNetError(err) {
-				log.Println("read request body with net error:", err, "method:", reqHeader.Method)
+		if server.authorizer != nil {
+			if err = server.authorize(conn, reqHeader); err != nil {
+				server.status.IncrDeniedAmount()
+				if !server.rejectCall(conn, reqHeader, ErrForbidden.SetReason(ErrForbidden.Reason+": "+err.Error())) {
+					goto fail
+				}
+				continue
+			}
+		}
+		if ok, reason := server.rateLimiter.allow(conn.RemoteAddr(), reqHeader.Service, reqHeader.Method); !ok {
+			server.status.IncrRateLimitedAmount()
+			if !server.rejectCall(conn, reqHeader, ErrRateLimited.SetReason(ErrRateLimited.Reason+": "+reason)) {
 				goto fail
+			}
+			continue
+		}
+
+		if !methodType.acquire() {
+			server.status.IncrOverloadAmount()
+			if !server.rejectCall(conn, reqHeader, ErrServerOverload.SetReason(ErrServerOverload.Reason+": max concurrency of "+reqHeader.Service+"."+reqHeader.Method)) {
+				goto fail
+			}
+			continue
+		}
+
+		var argv, replyv reflect.Value
+		// the methods taking a stream only receive the args by the stream
+		if methodType.ArgType != nil {
+			// Decode the argument value.
+			argIsValue := false // if true, need to indirect before calling.
+			if methodType.ArgType.Kind() == reflect.Ptr {
+				argv = reflect.New(methodType.ArgType.Elem())
 			} else {
-				server.replyCmd(conn, reqHeader.Seq, &Error{400, ErrTypeCritical, err.Error()}, CmdTypeErr)
+				argv = reflect.New(methodType.ArgType)
+				argIsValue = true
+			}
+			err = conn.ReadRequestBody(argv.Interface())
+			if err != nil {
+				methodType.release()
+				if !server.replyReadError(conn, reqHeader, err) {
+					goto fail
+				}
 				continue
 			}
+			if argIsValue {
+				argv = argv.Elem()
+			}
+		}
+		if !methodType.stream {
+			replyv = reflect.New(methodType.ReplyType.Elem())
 		}
-		if argIsValue {
-			argv = argv.Elem()
+		// the caller has stopped waiting, skip the service
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			methodType.release()
+			server.replyCmd(conn, reqHeader.Seq, ErrRequestExpired, CmdTypeErr)
+			continue
 		}
-		replyv = reflect.New(methodType.ReplyType.Elem())
-		if reqHeader.CallType == RequestSendOnly {
-			go server.asyncCallService(conn, reqHeader.Seq, service, methodType, argv, replyv)
+		// count before checking shutdown, Shutdown waits for the counted ones
+		atomic.AddInt64(&server.inflight, 1)
+		if server.isShutdown() {
+			atomic.AddInt64(&server.inflight, -1)
+			methodType.release()
+			server.replyCmd(conn, reqHeader.Seq, ErrServerShutdown, CmdTypeErr)
 			continue
 		}
-		go server.callService(conn, reqHeader.Seq, service, methodType, argv, replyv)
+		call := &ServerCall{
+			RemoteAddr: conn.RemoteAddr(),
+			Principal:  conn.principal,
+			Service:    reqHeader.Service,
+			Method:     reqHeader.Method,
+			Seq:        reqHeader.Seq,
+			Caller:     reqHeader.Caller,
+			Meta:       reqHeader.Meta,
+			service:    service,
+			methodType: methodType,
+			argv:       argv,
+			deadline:   deadline,
+			compress:   reqHeader.Compress,
+		}
+		if argv.IsValid() {
+			call.Arg = argv.Interface()
+		}
+		if methodType.stream {
+			stream := server.newServerStream(conn, call, reqHeader.CallType)
+			call.Context = stream.ctx
+			replyv = reflect.ValueOf(stream)
+		}
+		call.Reply = replyv.Interface()
+		call.replyv = replyv
+		if !server.dispatch(conn, call, reqHeader.CallType) {
+			atomic.AddInt64(&server.inflight, -1)
+			methodType.release()
+			if methodType.stream {
+				conn.removeStream(call.Reply.(*ServerStream))
+			}
+			server.status.IncrOverloadAmount()
+			server.replyCmd(conn, reqHeader.Seq, ErrServerOverload.SetReason(ErrServerOverload.Reason+": worker queue full"), CmdTypeErr)
+		}
 	}
 fail:
 	server.status.IncrErrorAmount()
+	conn.cancelStreams()
 	conn.Lock()
-	if conn.netError != nil {
+	if conn.netError == nil {
 		conn.netError = err
 	}
 	conn.Unlock()
@@ -212,6 +542,22 @@ fail:
 	return
 }
 
+// reply the error of reading request body to client,
+// return false if the connection can not be used any more
+func (server *Server) replyReadError(conn *ConnDriver, reqHeader *RequestHeader, err error) bool {
+	if e, ok := err.(*Error); ok {
+		// the body is too large and skipped
+		server.replyCmd(conn, reqHeader.Seq, e, CmdTypeErr)
+		return !conn.isStateful()
+	}
+	if isNetError(err) {
+		log.Println("read request body with net error:", err, "method:", reqHeader.Method)
+		return false
+	}
+	server.replyCmd(conn, reqHeader.Seq, &Error{400, ErrTypeCritical, err.Error()}, CmdTypeErr)
+	return true
+}
+
 func (server *Server) Status() *ServerStatusPerSecond {
 	return server.status.Status()
 }
@@ -226,64 +572,193 @@ func (server *Server) replyCmd(conn *ConnDriver, seq uint64, serverErr *Error, c
 		respHeader.ReplyType = ReplyTypePong
 	case CmdTypeAck:
 		respHeader.ReplyType = ReplyTypeAck
+	case CmdTypeGoAway:
+		respHeader.ReplyType = ReplyTypeGoAway
 	case CmdTypeErr:
 		respHeader.ReplyType = ReplyTypeAck
 		respHeader.Error = serverErr
 		// fmt.Println("replycmd send respHeader type error")
 	}
-	conn.Lock()
-	err := server.SendFrame(conn, respHeader, reflect.ValueOf(nil))
-	conn.Unlock()
+	err := server.sendFrame(conn, respHeader, reflect.ValueOf(nil))
 	if err != nil && !isNetError(err) {
-		log.Fatalln("encoding error:" + err.Error())
+		// the header can not be encoded, nothing to tell the client
+		server.status.IncrEncodeErrorAmount()
+		log.Println("encoding error:", err, "close connection:", conn.RemoteAddr())
+		server.closeConn(conn, err)
 	}
 	return
 }
 
+func (server *Server) authorize(conn *ConnDriver, reqHeader *RequestHeader) error {
+	return server.authorizer.Authorize(&AccessRequest{
+		RemoteAddr: conn.RemoteAddr(),
+		Principal:  conn.principal,
+		Caller:     reqHeader.Caller,
+		Service:    reqHeader.Service,
+		Method:     reqHeader.Method,
+	})
+}
+
+// skip the body of the request and reply rpcErr, return false if the connection is broken
+func (server *Server) rejectCall(conn *ConnDriver, reqHeader *RequestHeader, rpcErr *Error) bool {
+	if err := conn.ReadRequestBody(nil); err != nil {
+		return server.replyReadError(conn, reqHeader, err)
+	}
+	server.replyCmd(conn, reqHeader.Seq, rpcErr, CmdTypeErr)
+	return true
+}
+
+// the reply can not be encoded and nothing of it is written, reply the error instead.
+// the encoder of a stateful codec is reset, so the connection is still usable
+func (server *Server) replyEncodeError(conn *ConnDriver, call *ServerCall, err error) {
+	// the reply exceeds the max frame size of the client
+	if e, ok := err.(*CodecError); ok && IsRpcError(e.Err) {
+		server.replyCmd(conn, call.Seq, e.Err.(*Error), CmdTypeErr)
+		return
+	}
+	server.status.IncrEncodeErrorAmount()
+	log.Println("encoding error:", err, "method:", call.Service+"."+call.Method)
+	server.replyCmd(conn, call.Seq, ErrReplyEncodeFail.SetReason(ErrReplyEncodeFail.Reason+": "+err.Error()), CmdTypeErr)
+}
+
+// close the connection, ServeLoop exits on the read error
+func (server *Server) closeConn(conn *ConnDriver, err error) {
+	conn.Lock()
+	if conn.netError == nil {
+		conn.netError = err
+	}
+	conn.Unlock()
+	conn.Close()
+}
+
+// execute the call by the worker pool, or a new goroutine without the pool. the call
+// expired in the queue or rejected by the stopped pool is replied with the error without
+// executing. return false if the queue of the pool is full
+func (server *Server) dispatch(conn *ConnDriver, call *ServerCall, callType int16) bool {
+	task := func(run bool) {
+		if !run {
+			server.skipCall(conn, call, ErrServerShutdown.SetReason(ErrServerShutdown.Reason+": worker pool stopped"))
+			return
+		}
+		// the call waited in the queue until the caller stopped waiting
+		if !call.deadline.IsZero() && time.Now().After(call.deadline) {
+			server.skipCall(conn, call, ErrRequestExpired)
+			return
+		}
+		switch callType {
+		case RequestSendOnly:
+			server.asyncCallService(conn, call)
+		case RequestStream, RequestOpenStream:
+			server.callStream(conn, call)
+		default:
+			server.callService(conn, call)
+		}
+	}
+	if server.workers == nil {
+		go task(true)
+		return true
+	}
+	return server.workers.submit(task)
+}
+
+// reply rpcErr to the call dispatched but not executed
+func (server *Server) skipCall(conn *ConnDriver, call *ServerCall, rpcErr *Error) {
+	defer atomic.AddInt64(&server.inflight, -1)
+	call.methodType.release()
+	if call.methodType.stream {
+		conn.removeStream(call.Reply.(*ServerStream))
+	}
+	server.replyCmd(conn, call.Seq, rpcErr, CmdTypeErr)
+}
+
 // send response first telling client that server has received the request,then execute the service
-func (server *Server) asyncCallService(conn *ConnDriver, seq uint64, service *service, methodType *methodType, argv, replyv reflect.Value) {
-	server.replyCmd(conn, seq, nil, CmdTypeAck)
-	function := methodType.method.Func
+func (server *Server) asyncCallService(conn *ConnDriver, call *ServerCall) {
+	defer atomic.AddInt64(&server.inflight, -1)
+	defer call.methodType.release()
+	server.replyCmd(conn, call.Seq, nil, CmdTypeAck)
 	// Invoke the method, providing a new value for the reply.
-	function.Call([]reflect.Value{service.rcvr, argv, replyv})
+	// the caller does not wait for the service, so no deadline for it
+	call.Context = context.Background()
+	server.safeInvoke(call)
 	return
 }
 
 // do service and send response to client
-func (server *Server) callService(conn *ConnDriver, seq uint64, service *service, methodType *methodType, argv, replyv reflect.Value) {
-	function := methodType.method.Func
-
-	returnValues := function.Call([]reflect.Value{service.rcvr, argv, replyv})
-	// The return value for the method is an error.
-	errInter := returnValues[0].Interface()
-
-	respHeader := NewResponseHeader()
-	respHeader.ReplyType = ReplyTypeData
-	respHeader.Seq = seq
-	if errInter != nil {
-		switch errInter.(type) {
-		case *Error:
-			server.replyCmd(conn, seq, errInter.(*Error), CmdTypeErr)
-		case Error:
-			e := errInter.(Error)
-			server.replyCmd(conn, seq, &e, CmdTypeErr)
-		case error:
-			server.replyCmd(conn, seq, &Error{500, ErrTypeLogic, errInter.(error).Error()}, CmdTypeErr)
-		}
+func (server *Server) callService(conn *ConnDriver, call *ServerCall) {
+	defer atomic.AddInt64(&server.inflight, -1)
+	defer call.methodType.release()
+	call.Context = context.Background()
+	if !call.deadline.IsZero() {
+		var cancel context.CancelFunc
+		call.Context, cancel = context.WithDeadline(call.Context, call.deadline)
+		defer cancel()
+	}
+	if rpcErr := server.safeInvoke(call); rpcErr != nil {
+		server.replyCmd(conn, call.Seq, rpcErr, CmdTypeErr)
 		return
 	}
-	conn.Lock()
-	err := server.SendFrame(conn, respHeader, replyv)
-	conn.Unlock()
+	respHeader := NewResponseHeader()
+	respHeader.ReplyType = ReplyTypeData
+	respHeader.Seq = call.Seq
+	respHeader.compress = call.compress
+	err := server.sendFrame(conn, respHeader, call.replyv)
 	if err != nil && !isNetError(err) {
-		log.Fatalln("encoding error:" + err.Error())
+		server.replyEncodeError(conn, call, err)
 	}
 	return
 }
 
-// send request Header and body to client if encoding error not net error
-// stop write subsequence frame  and panic
+// invoke the call through the interceptors, recover the panic as ErrServicePanic
+func (server *Server) safeInvoke(call *ServerCall) (rpcErr *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.status.IncrPanicAmount()
+			stack := debug.Stack()
+			if server.panicHandler != nil {
+				server.panicHandler(call, r, stack)
+			} else {
+				log.Printf("service %s.%s panic: %v\n%s", call.Service, call.Method, r, stack)
+			}
+			rpcErr = ErrServicePanic.SetReason(fmt.Sprintf("%s %s.%s: %v", ErrServicePanic.Reason, call.Service, call.Method, r))
+		}
+	}()
+	return server.invoker(call)
+}
+
+// send response header and body to client. if encoding fails nothing is written
+// and the connection is left usable, other errors stop the subsequent frames
 func (server *Server) SendFrame(conn *ConnDriver, respHeader *ResponseHeader, replyv reflect.Value) error {
+	if err := server.bufferFrame(conn, respHeader, replyv); err != nil {
+		return err
+	}
+	return server.flush(conn)
+}
+
+// send the frame with the connection locked. the flush is left to the goroutine waiting
+// for the lock, so the frames of the concurrent calls are flushed together
+func (server *Server) sendFrame(conn *ConnDriver, respHeader *ResponseHeader, replyv reflect.Value) error {
+	atomic.AddInt32(&conn.writers, 1)
+	conn.Lock()
+	defer conn.Unlock()
+	waiting := atomic.AddInt32(&conn.writers, -1) > 0
+	err := server.bufferFrame(conn, respHeader, replyv)
+	if conn.netError == nil && !conn.coalesceFull() {
+		if waiting {
+			return err
+		}
+		if conn.coalesceDelay > 0 {
+			server.delayFlush(conn)
+			return err
+		}
+	}
+	if flushErr := server.flush(conn); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// write the frame to the write buffer of the connection
+func (server *Server) bufferFrame(conn *ConnDriver, respHeader *ResponseHeader, replyv reflect.Value) error {
 	var err error
 	if conn.netError != nil {
 		return conn.netError
@@ -292,27 +767,46 @@ func (server *Server) SendFrame(conn *ConnDriver, respHeader *ResponseHeader, re
 	if err != nil {
 		goto final
 	}
-	err = conn.WriteResponseHeader(respHeader)
-	if err != nil {
-		goto final
-	}
 	if respHeader.HaveReply() {
-		err = conn.WriteResponseBody(replyv.Interface())
-		if err != nil {
-			goto final
-		}
-	}
-	err = conn.FlushWriteToNet()
-	if err != nil {
-		goto final
+		err = conn.WriteResponse(respHeader, replyv.Interface())
+	} else {
+		err = conn.WriteResponse(respHeader, nil)
 	}
 final:
+	if err != nil && isNetError(err) {
+		conn.netError = err
+	}
+	return err
+}
+
+func (server *Server) flush(conn *ConnDriver) error {
+	if conn.netError != nil {
+		return conn.netError
+	}
+	err := conn.FlushWriteToNet()
 	if err != nil {
 		conn.netError = err
 	}
 	return err
 }
 
+// flush after coalesceDelay unless a frame fills the buffer first, called with the connection locked.
+// nothing is done if the frames are flushed by Shutdown or the connection is closed meanwhile
+func (server *Server) delayFlush(conn *ConnDriver) {
+	if conn.flushArmed {
+		return
+	}
+	conn.flushArmed = true
+	time.AfterFunc(conn.coalesceDelay, func() {
+		conn.Lock()
+		if conn.flushArmed {
+			conn.flushArmed = false
+			server.flush(conn)
+		}
+		conn.Unlock()
+	})
+}
+
 func (server *Server) Register(rcvr interface{}) error {
 	s := new(service)
 	s.typ = reflect.TypeOf(rcvr)
@@ -334,6 +828,10 @@ func (server *Server) Register(rcvr interface{}) error {
 	s.name = sname
 	// Install the methods
 	s.method = suitableMethods(s.typ, true)
+	for mname, err := range invalidMethods(server.codec, s.method) {
+		log.Println("method", mname, "not supported by codec", server.codec.Name()+":", err)
+		delete(s.method, mname)
+	}
 	if len(s.method) == 0 {
 		str := ""
 		// To help the user, see if a pointer receiver would work.
@@ -362,15 +860,32 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 		if method.PkgPath != "" {
 			continue
 		}
+		// a client or bidirectional stream method needs two ins: receiver, *ServerStream
+		if mtype.NumIn() == 2 && mtype.In(1) == typeOfServerStream {
+			if mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+				if reportErr {
+					log.Println("stream method", mname, "must return error only")
+				}
+				continue
+			}
+			methods[mname] = &methodType{method: method, ReplyType: typeOfServerStream, stream: true}
+			continue
+		}
 		// Method needs three ins: receiver, *args, *reply.
-		if mtype.NumIn() != 3 {
+		// or four ins with a context.Context ahead of *args
+		withContext := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+		argIndex := 1
+		if withContext {
+			argIndex = 2
+		}
+		if mtype.NumIn() != argIndex+2 {
 			if reportErr {
 				log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
 			}
 			continue
 		}
 		// First arg need not be a pointer.
-		argType := mtype.In(1)
+		argType := mtype.In(argIndex)
 		if !isExportedOrBuiltinType(argType) {
 			if reportErr {
 				log.Println(mname, "argument type not exported:", argType)
@@ -378,7 +893,7 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			continue
 		}
 		// Second arg must be a pointer.
-		replyType := mtype.In(2)
+		replyType := mtype.In(argIndex + 1)
 		if replyType.Kind() != reflect.Ptr {
 			if reportErr {
 				log.Println("method", mname, "reply type not a pointer:", replyType)
@@ -406,11 +921,34 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
-		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType, withContext: withContext, stream: replyType == typeOfServerStream}
 	}
 	return methods
 }
 
+// invalidMethods returns the methods whose args or reply can not be serialized by codec
+func invalidMethods(codec Codec, methods map[string]*methodType) map[string]error {
+	validator, ok := codec.(TypeValidator)
+	if !ok {
+		return nil
+	}
+	invalid := make(map[string]error)
+	for mname, m := range methods {
+		if m.ArgType == nil {
+			// the values received on a stream are checked by the decoder
+			continue
+		} else if err := validator.ValidateType(m.ArgType); err != nil {
+			invalid[mname] = err
+		} else if m.stream {
+			// the values sent on a stream are checked by the encoder
+			continue
+		} else if err := validator.ValidateType(m.ReplyType); err != nil {
+			invalid[mname] = err
+		}
+	}
+	return invalid
+}
+
 // Is this an exported - upper case - name
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -1,16 +1,58 @@
 package gorpc
 
 import (
+	"context"
 	"reflect"
 	"sync"
+	"sync/atomic"
 )
 
 type methodType struct {
-	sync.Mutex // protects counters
-	method     reflect.Method
-	ArgType    reflect.Type
-	ReplyType  reflect.Type
-	numCalls   uint
+	sync.Mutex  // protects counters
+	method      reflect.Method
+	ArgType     reflect.Type
+	ReplyType   reflect.Type
+	withContext bool // method takes a context.Context as the first parameter
+	stream      bool // method sends the replies by a *ServerStream, no ArgType if it receives the args by it
+	numCalls    uint
+	maxRunning  int32 // max calls executing at the same time, 0 means no limit
+	running     int32
+}
+
+// count the call executing, return false if it exceeds the max concurrency
+func (m *methodType) acquire() bool {
+	running := atomic.AddInt32(&m.running, 1)
+	if max := atomic.LoadInt32(&m.maxRunning); max > 0 && running > max {
+		atomic.AddInt32(&m.running, -1)
+		return false
+	}
+	return true
+}
+
+func (m *methodType) release() {
+	atomic.AddInt32(&m.running, -1)
+}
+
+// the stream methods must be called by the stream call types, the others by the plain ones
+func (m *methodType) accept(callType int16) bool {
+	switch {
+	case !m.stream:
+		return callType != RequestStream && callType != RequestOpenStream
+	case m.ArgType == nil:
+		return callType == RequestOpenStream
+	}
+	return callType == RequestStream
+}
+
+// invoke the method of the service
+func (m *methodType) call(ctx context.Context, s *service, argv, replyv reflect.Value) []reflect.Value {
+	if m.ArgType == nil {
+		return m.method.Func.Call([]reflect.Value{s.rcvr, replyv})
+	}
+	if m.withContext {
+		return m.method.Func.Call([]reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv})
+	}
+	return m.method.Func.Call([]reflect.Value{s.rcvr, argv, replyv})
 }
 
 type service struct {
@@ -17,13 +17,43 @@ const (
 	DefaultConnectTimeout  = 30 * time.Second // default connect timeout
 	DefaultPingInterval    = 50 * time.Second // conn idle beyond DefaultPingInterval  send a ping packet to server
 	DefaultTimerGCInterval = time.Second
+	DefaultMaxResponseSize = 64 << 20 // max body size of a response
+	// bodies smaller than it are not compressed, compression costs more than it saves
+	DefaultCompressThreshold = 1024
 )
 
 // server setting
 const (
 	DefaultServerIdleTimeout = time.Second * 300
+	DefaultMaxRequestSize    = 16 << 20 // max body size of a request
+	// wait the client to finish the handshake of a new connection
+	DefaultServerHandshakeTimeout = time.Second * 10
 	// client wait server to close the connection
 	DefaultClientWaitResponseTimeout = DefaultServerIdleTimeout + time.Second*10
 
 	DefaultServerTimerGCInterval = DefaultServerIdleTimeout / 2
+	// how often Shutdown checks whether the in-flight calls have finished
+	ShutdownPollInterval = 50 * time.Millisecond
+	// how often the rate limiter drops the buckets of the clients gone
+	RateLimitSweepInterval = time.Minute
+)
+
+// write setting
+const (
+	// bytes of the frames flushed to the network together at most, the frames queued
+	// while writing are flushed with one syscall
+	DefaultWriteCoalesceBytes = 4096
+)
+
+// stream setting
+const (
+	// bytes a stream sends before the receiver grants more, so a stream can not
+	// fill the memory of a slow receiver or starve the other calls of the connection
+	DefaultStreamWindow = 256 << 10
+)
+
+// tls setting
+const (
+	// how often CertReloader checks whether the certificate files are modified
+	DefaultCertCheckInterval = 10 * time.Second
 )
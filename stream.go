@@ -0,0 +1,665 @@
+package gorpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+// rawBody is a body encoded by the encoder of a stream, written as it is
+type rawBody []byte
+
+// streamSend encodes the values sent on a stream and waits for the window of the receiver.
+// every stream has its own encoder, so the frames of a stream are decoded apart from
+// the other frames of the connection
+type streamSend struct {
+	enc      Encoder
+	encBuf   bytes.Buffer
+	stateful bool
+	err      error // the encoder of a stateful codec is broken once encoding fails
+
+	sync.Mutex               // protects following
+	window     int64         // bytes the receiver can take, below 0 after a frame larger than it
+	closed     error         // the values can not be sent any more
+	notify     chan struct{} // signaled when the window is granted or the stream closed
+}
+
+func newStreamSend(codec Codec) *streamSend {
+	s := &streamSend{window: DefaultStreamWindow, notify: make(chan struct{}, 1)}
+	s.enc = codec.NewEncoder(&s.encBuf)
+	if c, ok := codec.(StatefulCodec); ok {
+		s.stateful = c.Stateful()
+	}
+	return s
+}
+
+// the body is valid until the next encode
+func (s *streamSend) encode(v interface{}) (rawBody, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.encBuf.Reset()
+	if err := s.enc.Encode(v); err != nil {
+		err = asCodecError(err)
+		if s.stateful {
+			s.err = err
+		}
+		return nil, err
+	}
+	return rawBody(s.encBuf.Bytes()), nil
+}
+
+// wait until the window is open and take n bytes from it. a frame larger than
+// the window is sent once the window is open, so it can not block the stream forever
+func (s *streamSend) acquire(ctx context.Context, n int) error {
+	for {
+		s.Lock()
+		if s.closed != nil {
+			err := s.closed
+			s.Unlock()
+			return err
+		}
+		if s.window > 0 {
+			s.window -= int64(n)
+			s.Unlock()
+			return nil
+		}
+		s.Unlock()
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// the receiver has consumed n bytes
+func (s *streamSend) grant(n uint32) {
+	s.Lock()
+	s.window += int64(n)
+	s.Unlock()
+	signal(s.notify)
+}
+
+// the values sent afterwards fail with err
+func (s *streamSend) close(err error) {
+	s.Lock()
+	if s.closed == nil {
+		s.closed = err
+	}
+	s.Unlock()
+	signal(s.notify)
+}
+
+// streamRecv queues the frames of a stream until they are decoded
+type streamRecv struct {
+	sync.Mutex
+	frames   [][]byte
+	err      error         // set when the stream ends, io.EOF for the normal end
+	consumed int64         // bytes decoded but not granted to the sender yet
+	unacked  int64         // bytes pushed but not granted to the sender yet
+	notify   chan struct{} // signaled when a frame arrives or the stream ends
+	dec      Decoder
+	decBuf   bytes.Buffer
+}
+
+func newStreamRecv(codec Codec) *streamRecv {
+	r := &streamRecv{notify: make(chan struct{}, 1)}
+	r.dec = codec.NewDecoder(&r.decBuf)
+	return r
+}
+
+// the frames pushed after the stream ends are dropped. the sender sends a frame only
+// while its window is open, ErrFlowControl is returned for the frame beyond the window
+func (r *streamRecv) push(frame []byte) error {
+	r.Lock()
+	if r.err == nil {
+		if r.unacked >= DefaultStreamWindow {
+			r.Unlock()
+			return ErrFlowControl
+		}
+		r.unacked += int64(len(frame))
+		r.frames = append(r.frames, frame)
+	}
+	r.Unlock()
+	signal(r.notify)
+	return nil
+}
+
+// end the stream with err, the frames queued are still received
+func (r *streamRecv) finish(err error) {
+	r.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.Unlock()
+	signal(r.notify)
+}
+
+func signal(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// decode the next frame into v, wait until a frame arrives, the stream ends or ctx is done.
+// credit is the bytes to grant the sender, granted in batches of half the window
+func (r *streamRecv) recv(ctx context.Context, v interface{}) (credit uint32, err error) {
+	for {
+		r.Lock()
+		if len(r.frames) > 0 {
+			frame := r.frames[0]
+			r.frames[0] = nil
+			r.frames = r.frames[1:]
+			r.consumed += int64(len(frame))
+			if r.consumed >= DefaultStreamWindow/2 {
+				credit = uint32(r.consumed)
+				r.unacked -= r.consumed
+				r.consumed = 0
+			}
+			r.Unlock()
+			r.decBuf.Reset()
+			r.decBuf.Write(frame)
+			if err = r.dec.Decode(v); err != nil {
+				return credit, ErrGobParseErr.SetError(err)
+			}
+			return credit, nil
+		}
+		err = r.err
+		r.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-r.notify:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// ServerStream sends and receives the values of a stream method. a server-streaming
+// method takes an argument and sends the replies:
+//
+//	func (t *T) MethodName(argType T1, stream *gorpc.ServerStream) error
+//
+// with an optional context.Context ahead of argType. a client-streaming or
+// bidirectional method receives the values of the client by the stream:
+//
+//	func (t *T) MethodName(stream *gorpc.ServerStream) error
+//
+// the stream ends when the method returns, the client receives the error returned
+type ServerStream struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	server   *Server
+	conn     *ConnDriver
+	seq      uint64
+	compress int8
+	send     *streamSend
+	recv     *streamRecv
+}
+
+// canceled when the client closes the stream or the connection breaks
+func (ss *ServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// send v to the client, not safe for concurrent use. it waits while the client has
+// not consumed the window of the stream. returns error if v can not be encoded,
+// the stream is canceled or the connection is broken
+func (ss *ServerStream) Send(v interface{}) error {
+	if err := ss.ctx.Err(); err != nil {
+		return err
+	}
+	body, err := ss.send.encode(v)
+	if err != nil {
+		return err
+	}
+	if err = ss.send.acquire(ss.ctx, len(body)); err != nil {
+		return err
+	}
+	respHeader := NewResponseHeader()
+	respHeader.Seq = ss.seq
+	respHeader.ReplyType = ReplyTypeData | ReplyTypeStream
+	respHeader.compress = ss.compress
+	return ss.server.sendFrame(ss.conn, respHeader, reflect.ValueOf(body))
+}
+
+// decode the next value sent by the client into v, not safe for concurrent use.
+// io.EOF is returned after the client calls CloseSend, at once for the
+// server-streaming methods
+func (ss *ServerStream) Recv(v interface{}) error {
+	credit, err := ss.recv.recv(ss.ctx, v)
+	if credit > 0 {
+		respHeader := NewResponseHeader()
+		respHeader.Seq = ss.seq
+		respHeader.ReplyType = ReplyTypeWindow
+		respHeader.Window = credit
+		ss.server.sendFrame(ss.conn, respHeader, reflect.ValueOf(nil))
+	}
+	return err
+}
+
+func (server *Server) newServerStream(conn *ConnDriver, call *ServerCall, callType int16) *ServerStream {
+	ss := &ServerStream{
+		server:   server,
+		conn:     conn,
+		seq:      call.Seq,
+		compress: call.compress,
+		send:     newStreamSend(conn.codec),
+		recv:     newStreamRecv(conn.codec),
+	}
+	if callType == RequestStream {
+		// the client sends the argument only
+		ss.recv.finish(io.EOF)
+	}
+	if call.deadline.IsZero() {
+		ss.ctx, ss.cancel = context.WithCancel(context.Background())
+	} else {
+		ss.ctx, ss.cancel = context.WithDeadline(context.Background(), call.deadline)
+	}
+	conn.Lock()
+	if conn.streams == nil {
+		conn.streams = make(map[uint64]*ServerStream)
+	}
+	conn.streams[ss.seq] = ss
+	conn.Unlock()
+	return ss
+}
+
+// run the stream method and end the stream with the error returned
+func (server *Server) callStream(conn *ConnDriver, call *ServerCall) {
+	defer atomic.AddInt64(&server.inflight, -1)
+	defer call.methodType.release()
+	ss := call.Reply.(*ServerStream)
+	defer conn.removeStream(ss)
+	rpcErr := server.safeInvoke(call)
+	respHeader := NewResponseHeader()
+	respHeader.Seq = call.Seq
+	respHeader.ReplyType = ReplyTypeStreamEnd
+	respHeader.Error = rpcErr
+	server.sendFrame(conn, respHeader, reflect.ValueOf(nil))
+}
+
+// route the frame to the stream of its seq, the frames of the streams ended are dropped.
+// return false if the connection is broken
+func (server *Server) readStreamFrame(conn *ConnDriver, reqHeader *RequestHeader) bool {
+	conn.Lock()
+	ss := conn.streams[reqHeader.Seq]
+	conn.Unlock()
+	switch reqHeader.CallType {
+	case RequestStreamData:
+		body, err := conn.readStreamBody(ErrRequestTooLarge)
+		if err != nil {
+			if isNetError(err) && !IsRpcError(err) {
+				return false
+			}
+			// a frame is lost, the stream can not go on
+			if ss != nil {
+				if e, ok := err.(*Error); ok {
+					ss.recv.finish(e)
+				} else {
+					ss.recv.finish(&Error{400, ErrTypeCritical, err.Error()})
+				}
+			}
+			return true
+		}
+		if ss != nil {
+			if err = ss.recv.push(body); err != nil {
+				server.resetStream(conn, ss, err.(*Error))
+			}
+		}
+	case RequestCloseSend:
+		if ss != nil {
+			ss.recv.finish(io.EOF)
+		}
+	case RequestWindow:
+		if ss != nil {
+			ss.send.grant(reqHeader.Window)
+		}
+	case RequestCancel:
+		if ss != nil {
+			ss.cancel()
+		}
+	}
+	return true
+}
+
+// end the stream with rpcErr before the stream method returns, the frames of
+// the stream are dropped afterwards and the method is canceled
+func (server *Server) resetStream(conn *ConnDriver, ss *ServerStream, rpcErr *Error) {
+	ss.recv.finish(rpcErr)
+	conn.removeStream(ss)
+	respHeader := NewResponseHeader()
+	respHeader.Seq = ss.seq
+	respHeader.ReplyType = ReplyTypeStreamEnd
+	respHeader.Error = rpcErr
+	server.sendFrame(conn, respHeader, reflect.ValueOf(nil))
+}
+
+func (conn *ConnDriver) removeStream(ss *ServerStream) {
+	ss.cancel()
+	conn.Lock()
+	delete(conn.streams, ss.seq)
+	conn.Unlock()
+}
+
+// the connection is broken, cancel all the streams
+func (conn *ConnDriver) cancelStreams() {
+	conn.Lock()
+	for _, ss := range conn.streams {
+		ss.cancel()
+	}
+	conn.Unlock()
+}
+
+// Stream sends and receives the values of a stream call
+type Stream struct {
+	ctx           context.Context
+	conn          *ConnDriver
+	seq           uint64
+	compress      int8
+	writeTimeout  time.Duration
+	send          *streamSend
+	recv          *streamRecv
+	closeSendOnce sync.Once
+	closeOnce     sync.Once
+	stopWatch     func() bool // stops watching ctx, guarded by the lock of recv
+}
+
+// send v to the stream method, not safe for concurrent use. it waits while the server
+// has not consumed the window of the stream. io.EOF is returned if the stream has
+// ended, Recv tells the error of the stream method. ErrRequestCanceled is returned once ctx is done
+func (s *Stream) Send(v interface{}) error {
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		return ErrRequestCanceled.SetError(ctxErr)
+	}
+	body, err := s.send.encode(v)
+	if err != nil {
+		return err
+	}
+	if err = s.send.acquire(s.ctx, len(body)); err != nil {
+		return s.canceled(err)
+	}
+	request := s.newRequest(RequestStreamData)
+	request.header.Compress = s.compress
+	// written later by the write goroutine
+	request.body = append(rawBody(nil), body...)
+	return s.enqueue(request)
+}
+
+// tell the stream method no more values are sent, its Recv returns io.EOF.
+// the replies are still received by Recv
+func (s *Stream) CloseSend() error {
+	var err error
+	s.closeSendOnce.Do(func() {
+		s.send.close(ErrStreamClosed)
+		// the stream is canceled on the server already
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			err = ErrRequestCanceled.SetError(ctxErr)
+			return
+		}
+		err = s.enqueue(s.newRequest(RequestCloseSend))
+	})
+	return err
+}
+
+// decode the next reply into v, not safe for concurrent use. io.EOF is returned
+// after the last reply, or the *Error if the stream method fails
+func (s *Stream) Recv(v interface{}) error {
+	credit, err := s.recv.recv(s.ctx, v)
+	if credit > 0 {
+		request := s.newRequest(RequestWindow)
+		request.header.Window = credit
+		s.enqueue(request)
+	}
+	if err != nil && err != io.EOF {
+		s.Close()
+		return s.canceled(err)
+	}
+	return err
+}
+
+// cancel the stream, the context of the stream method on the server is canceled.
+// the replies not received are dropped
+func (s *Stream) Close() error {
+	s.close(true)
+	return nil
+}
+
+// end the stream and tell the server once
+func (s *Stream) close(wait bool) {
+	s.closeOnce.Do(func() {
+		s.end(ErrStreamClosed)
+		s.cancelServer(wait)
+	})
+}
+
+// tell the server to cancel the stream unless it has ended. the read goroutine of the
+// connection does not wait for the write queue, the cancel is queued by a new goroutine if it is full
+func (s *Stream) cancelServer(wait bool) {
+	request := s.newRequest(RequestCancel)
+	s.conn.Lock()
+	// the stream has ended, or the connection is broken
+	if s.conn.RemovePendingResponse(s.seq) == nil || s.conn.netError != nil {
+		s.conn.Unlock()
+		return
+	}
+	err := s.conn.AddPendingRequest(request)
+	s.conn.Unlock()
+	if err != ErrPendingRequestFull {
+		return
+	}
+	if wait {
+		s.enqueue(request)
+	} else {
+		go s.enqueue(request)
+	}
+}
+
+// cancel the stream on the server once ctx is done, even if Send and Recv are not called.
+// Recv and Send still fail with ErrRequestCanceled by ctx
+func (s *Stream) watch() {
+	stop := context.AfterFunc(s.ctx, func() { s.cancelServer(true) })
+	s.recv.Lock()
+	ended := s.recv.err != nil
+	s.stopWatch = stop
+	s.recv.Unlock()
+	if ended {
+		stop()
+	}
+}
+
+// the stream has ended, Send and Recv fail with err
+func (s *Stream) end(err error) {
+	s.recv.finish(err)
+	s.send.close(err)
+	s.recv.Lock()
+	stop := s.stopWatch
+	s.recv.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+func (s *Stream) canceled(err error) error {
+	if ctxErr := s.ctx.Err(); ctxErr != nil && err == ctxErr {
+		return ErrRequestCanceled.SetError(ctxErr)
+	}
+	return err
+}
+
+// the frames of the stream are routed by seq, no service and method
+func (s *Stream) newRequest(callType int16) *Request {
+	request := NewRequest()
+	request.header.Seq = s.seq
+	request.header.CallType = callType
+	request.writeTimeout = s.writeTimeout
+	return request
+}
+
+// queue the frame to the write goroutine, wait while the queue is full
+func (s *Stream) enqueue(request *Request) error {
+	for {
+		s.conn.Lock()
+		if s.conn.netError != nil {
+			s.conn.Unlock()
+			return ErrPendingWireBroken
+		}
+		err := s.conn.AddPendingRequest(request)
+		s.conn.Unlock()
+		if err != ErrPendingRequestFull {
+			return err
+		}
+		select {
+		case <-s.conn.writable:
+		case <-s.conn.done:
+			return ErrPendingWireBroken
+		case <-s.ctx.Done():
+			return ErrRequestCanceled.SetError(s.ctx.Err())
+		}
+	}
+}
+
+// Stream calls the server-streaming method of a server, see StreamWithAddress
+func (this *Client) Stream(ctx context.Context, service, method string, args interface{}) (*Stream, *Error) {
+	serverAddress, err := this.getAddress()
+	if err != nil {
+		return nil, err
+	}
+	return this.StreamWithAddress(ctx, serverAddress, service, method, args)
+}
+
+// StreamWithAddress calls the server-streaming method of the server, the replies are
+// received by Stream.Recv until io.EOF. the stream is canceled once ctx is done or
+// Stream.Close is called, call Close if the replies are not received to the end.
+// the stream is not retried and the interceptors of the client are not applied
+func (this *Client) StreamWithAddress(ctx context.Context, serverAddress, service, method string, args interface{}) (*Stream, *Error) {
+	return this.openStream(ctx, serverAddress, service, method, RequestStream, args)
+}
+
+// OpenStream opens a client-streaming or bidirectional stream to a server, see OpenStreamWithAddress
+func (this *Client) OpenStream(ctx context.Context, service, method string) (*Stream, *Error) {
+	serverAddress, err := this.getAddress()
+	if err != nil {
+		return nil, err
+	}
+	return this.OpenStreamWithAddress(ctx, serverAddress, service, method)
+}
+
+// OpenStreamWithAddress opens a client-streaming or bidirectional stream to the method
+// taking a *ServerStream only. the values are sent by Stream.Send and CloseSend tells
+// the method the end, the replies are received by Stream.Recv until io.EOF.
+// the stream shares a pooled connection with the other calls
+func (this *Client) OpenStreamWithAddress(ctx context.Context, serverAddress, service, method string) (*Stream, *Error) {
+	return this.openStream(ctx, serverAddress, service, method, RequestOpenStream, nil)
+}
+
+func (this *Client) openStream(ctx context.Context, serverAddress, service, method string, callType int16, args interface{}) (*Stream, *Error) {
+	if serverAddress == "" {
+		return nil, ErrInvalidAddress.SetReason("client remote address is empty")
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ErrRequestCanceled.SetError(ctxErr)
+	}
+	netOptions := this.getNetOptions(service, method)
+	rpcConn, err := this.getConnPool(serverAddress).Conn(netOptions.connectTimeout, false)
+	if err != nil {
+		return nil, err
+	}
+	request := NewRequest()
+	request.header.Service = service
+	request.header.Method = method
+	request.header.CallType = callType
+	request.header.Compress = netOptions.compress
+	this.RLock()
+	request.header.Caller = this.caller
+	this.RUnlock()
+	request.body = args
+	request.writeTimeout = netOptions.writeTimeout
+	if ctxDeadline, ok := ctx.Deadline(); ok {
+		request.deadline = ctxDeadline
+	}
+	stream := &Stream{
+		ctx:          ctx,
+		conn:         rpcConn,
+		compress:     netOptions.compress,
+		writeTimeout: netOptions.writeTimeout,
+		send:         newStreamSend(rpcConn.codec),
+		recv:         newStreamRecv(rpcConn.codec),
+	}
+	presp := NewPendingResponse()
+	presp.stream = stream
+	if err = this.transfer(rpcConn, request, presp); err != nil {
+		return nil, err
+	}
+	stream.seq = presp.seq
+	stream.watch()
+	return stream, nil
+}
+
+// read the frame of the stream call, return error if the connection is broken
+func (cp *ConnPool) readStream(rpcConn *ConnDriver, respHeader *ResponseHeader, stream *Stream) error {
+	if respHeader.ReplyType == ReplyTypeWindow {
+		stream.send.grant(respHeader.Window)
+		return nil
+	}
+	if !respHeader.isStreamData() {
+		// the end of the stream, or the call rejected
+		switch {
+		case respHeader.Error != nil:
+			stream.end(respHeader.Error)
+		case respHeader.ReplyType&ReplyTypeStreamEnd > 0:
+			stream.end(io.EOF)
+		default:
+			stream.end(ErrUnknow.SetReason("client unexpected reply of stream"))
+		}
+		if respHeader.HaveReply() {
+			return rpcConn.ReadResponseBody(nil)
+		}
+		return nil
+	}
+	body, err := rpcConn.readStreamBody(ErrResponseTooLarge)
+	if err != nil {
+		if isNetError(err) && !IsRpcError(err) {
+			stream.end(ErrNetReadFail.SetError(err))
+			return err
+		}
+		// a frame is lost, the stream can not go on
+		if e, ok := err.(*Error); ok {
+			stream.recv.finish(e)
+		} else {
+			stream.recv.finish(ErrGobParseErr.SetError(err))
+		}
+		stream.close(false)
+		return nil
+	}
+	if err = stream.recv.push(body); err != nil {
+		// the server has sent beyond the window
+		stream.recv.finish(err)
+		stream.close(false)
+	}
+	return nil
+}
+
+// skip the body of the frame whose caller is gone, return error if the connection is broken
+func (cp *ConnPool) discardResponse(rpcConn *ConnDriver, respHeader *ResponseHeader) error {
+	var err error
+	if respHeader.isStreamData() {
+		_, err = rpcConn.readStreamBody(ErrResponseTooLarge)
+	} else if respHeader.HaveReply() {
+		err = rpcConn.ReadResponseBody(nil)
+	}
+	if err != nil && (isNetError(err) && !IsRpcError(err) || rpcConn.isStateful()) {
+		return err
+	}
+	return nil
+}
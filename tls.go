@@ -0,0 +1,85 @@
+package gorpc
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader reloads the certificate when the certificate or key file is
+// modified, so that the certificate can be renewed without restarting.
+// use GetCertificate for the server and GetClientCertificate for the client:
+//
+//	config := &tls.Config{GetCertificate: reloader.GetCertificate}
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	sync.RWMutex // protects following
+	cert         *tls.Certificate
+	modTime      time.Time // latest modification time of the files loaded
+	checkTime    time.Time // last time the files are checked
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load the certificate from the files, the certificate in use is kept if loading fails
+func (cr *CertReloader) Reload() error {
+	modTime := cr.filesModTime()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.checkTime = time.Now()
+	cr.Unlock()
+	return nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.certificate(), nil
+}
+
+func (cr *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.certificate(), nil
+}
+
+// check the files at most once per DefaultCertCheckInterval
+func (cr *CertReloader) certificate() *tls.Certificate {
+	now := time.Now()
+	cr.Lock()
+	check := now.Sub(cr.checkTime) >= DefaultCertCheckInterval
+	if check {
+		cr.checkTime = now
+	}
+	modTime := cr.modTime
+	cr.Unlock()
+	if check && cr.filesModTime().After(modTime) {
+		if err := cr.Reload(); err != nil {
+			log.Println("reload certificate error:", err, "cert file:", cr.certFile)
+		}
+	}
+	cr.RLock()
+	cert := cr.cert
+	cr.RUnlock()
+	return cert
+}
+
+func (cr *CertReloader) filesModTime() time.Time {
+	var modTime time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
@@ -0,0 +1,60 @@
+package gorpc
+
+import (
+	"sync"
+)
+
+// workerPool executes the calls by a fixed number of goroutines,
+// the calls wait in a bounded queue for a free worker
+type workerPool struct {
+	tasks    chan func(run bool) // run is false for the task rejected by stop
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{
+		tasks: make(chan func(run bool), queueSize),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case task := <-p.tasks:
+			task(true)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// queue the task, return false if the queue is full
+func (p *workerPool) submit(task func(run bool)) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// the workers exit, the tasks still queued are rejected without running
+func (p *workerPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		for {
+			select {
+			case task := <-p.tasks:
+				task(false)
+			default:
+				return
+			}
+		}
+	})
+}